@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"net/http"
+	"safestore/database"
+	"safestore/rules"
+	"safestore/utils"
+	"strings"
+)
+
+// authorize checks the caller of the request against the security rules.
+// It writes the error response and returns false when the operation is refused.
+func authorize(w http.ResponseWriter, r *http.Request, manager *utils.Manager, op rules.Operation, path string, newData interface{}) bool {
+	identity, err := manager.AuthenticateRequest(r)
+	if err != nil {
+		utils.FormatHttpError(w, http.StatusUnauthorized, "Unauthorized", err.Error())
+		return false
+	}
+	if !manager.Authorize(identity, op, path, newData) {
+		utils.FormatHttpError(w, http.StatusForbidden, "Forbidden", "Security rules refused the "+string(op)+" of "+path)
+		return false
+	}
+	return true
+}
+
+// documentRulePath returns the slash separated path of a document used by the security rules
+func documentRulePath(collection, id string) string {
+	return strings.ReplaceAll(collection, ".", "/") + "/" + id
+}
+
+// collectionRulePath returns the slash separated path of a collection used by the security rules
+func collectionRulePath(collection string) string {
+	return strings.ReplaceAll(database.PathToLTree(collection), ".", "/")
+}
+
+// treeRulePath returns the slash separated path of a SafeRow tree node used by the security rules
+func treeRulePath(path string) string {
+	return database.LTreeToTreePath(database.TreePathToLTree(path))
+}
+
+// authorizeRealtime checks the identity of a websocket client against the security rules
+func authorizeRealtime(manager *utils.Manager, userID string, op rules.Operation, path string, newData interface{}) bool {
+	return manager.Authorize(manager.WebsocketManager.Identity(userID), op, treeRulePath(path), newData)
+}
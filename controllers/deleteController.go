@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"safestore/database"
+	"safestore/rules"
+	"safestore/utils"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+func DeleteController(w http.ResponseWriter, r *http.Request, manager *utils.Manager) {
+	collection, id := parseDatabasePath(r)
+
+	if id == "" {
+		// delete the whole collection
+		if !authorize(w, r, manager, rules.Write, strings.ReplaceAll(collection, ".", "/"), nil) {
+			return
+		}
+		deleted, err := database.DeleteCollection(manager.DB, collection)
+		if err != nil {
+			utils.FormatHttpError(w, 500, err.Error(), "Error deleting collection")
+			return
+		}
+		if deleted == 0 {
+			utils.FormatHttpError(w, http.StatusNotFound, "Not found", "No document is stored in "+collection)
+			return
+		}
+	} else {
+		ifVersion, err := parseIfMatch(r)
+		if err != nil {
+			utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Error parsing If-Match")
+			return
+		}
+		if !authorize(w, r, manager, rules.Write, documentRulePath(collection, id), nil) {
+			return
+		}
+		err = database.DeleteInterface(manager.DB, collection, id, ifVersion)
+		if errors.Is(err, database.ErrVersionMismatch) {
+			utils.FormatHttpError(w, http.StatusPreconditionFailed, err.Error(), "Document was modified")
+			return
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.FormatHttpError(w, http.StatusNotFound, err.Error(), "Document not found")
+			return
+		}
+		if err != nil {
+			utils.FormatHttpError(w, 500, err.Error(), "Error deleting interface")
+			return
+		}
+	}
+
+	manager.PublishChange(utils.ChangeEvent{
+		Table:      utils.StoreRowsTable,
+		Op:         utils.DeleteOp,
+		Collection: collection,
+		ID:         id,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,32 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"safestore/database"
+	"strconv"
+	"strings"
+)
+
+// parseIfMatch returns the document version required by the If-Match header, 0 when there is none
+// and database.AnyVersion for `*`, which only requires the document to exist
+func parseIfMatch(r *http.Request) (int64, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	switch header {
+	case "":
+		return 0, nil
+	case "*":
+		return database.AnyVersion, nil
+	}
+	tag := strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("invalid If-Match header %q", header)
+	}
+	return version, nil
+}
+
+// setETag exposes the document version as its ETag
+func setETag(w http.ResponseWriter, version int64) {
+	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, version))
+}
@@ -1,37 +1,63 @@
 package controllers
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"safestore/database"
+	"safestore/rules"
 	"safestore/utils"
+	"strconv"
 	"strings"
 
 	"gorm.io/gorm"
 )
 
-func GetController(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
-	// get the collection from the URL
-	path := strings.TrimPrefix(r.URL.Path, "/database/")
-	urlPaths := strings.Split(path, "/")
+func GetController(w http.ResponseWriter, r *http.Request, manager *utils.Manager) {
+	db := manager.DB
+	// get the collection and the optional document id from the URL
+	collection, id := parseDatabasePath(r)
+	// get the collection data
 
-	var collection string = ""
-	var id string = ""
-	if len(urlPaths)%2 == 0 {
-		id = urlPaths[len(urlPaths)-1]
-		collection = strings.Join(urlPaths[:len(urlPaths)-1], ".")
-	} else {
-		id = ""
-		collection = strings.Join(urlPaths, ".")
+	rulePath := collectionRulePath(collection)
+	if id != "" {
+		rulePath = documentRulePath(collection, id)
+	}
+	if !authorize(w, r, manager, rules.Read, rulePath, nil) {
+		return
 	}
-	// get the collection data
 
-	if len(urlPaths)%2 == 0 {
-		parentRow, err := database.GetInterface(db, collection, id)
+	if id != "" {
+		parentRow, version, err := database.GetInterfaceWithVersion(db, collection, id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.FormatHttpError(w, http.StatusNotFound, err.Error(), "Document not found")
+			return
+		}
 		if err != nil {
 			utils.FormatHttpError(w, 500, err.Error(), "Error getting parent collection")
 			return
 		}
+		setETag(w, version)
 		utils.FormatHttpSuccess(w, parentRow)
+	} else if page, paginated, err := parsePage(r); paginated {
+		if err != nil {
+			utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Invalid pagination parameters")
+			return
+		}
+		result, err := database.GetCollectionPage(db, collection, database.Query{}, page)
+		if errors.Is(err, database.ErrInvalidCursor) {
+			utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Invalid pagination cursor")
+			return
+		}
+		if errors.Is(err, database.ErrInvalidPage) {
+			utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Invalid pagination parameters")
+			return
+		}
+		if err != nil {
+			utils.FormatHttpError(w, 500, err.Error(), "Error getting collection page")
+			return
+		}
+		utils.FormatHttpSuccess(w, result)
 	} else {
 		rows, err := database.GetCollection(db, collection)
 		if err != nil {
@@ -41,3 +67,43 @@ func GetController(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 		utils.FormatHttpSuccess(w, rows)
 	}
 }
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// parsePage reads the orderBy, direction, limit, startAfter and endBefore query parameters.
+// It reports whether the request asked for a paginated read at all.
+func parsePage(r *http.Request) (database.Page, bool, error) {
+	query := r.URL.Query()
+	page := database.Page{
+		OrderBy:    query.Get("orderBy"),
+		StartAfter: query.Get("startAfter"),
+		EndBefore:  query.Get("endBefore"),
+		Limit:      defaultPageLimit,
+	}
+	paginated := false
+	for _, key := range []string{"orderBy", "direction", "limit", "startAfter", "endBefore"} {
+		if query.Has(key) {
+			paginated = true
+		}
+	}
+
+	switch strings.ToLower(query.Get("direction")) {
+	case "", "asc":
+	case "desc":
+		page.Descending = true
+	default:
+		return page, paginated, fmt.Errorf("direction must be asc or desc")
+	}
+
+	if query.Has("limit") {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > maxPageLimit {
+			return page, paginated, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		page.Limit = limit
+	}
+	return page, paginated, nil
+}
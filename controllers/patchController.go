@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"safestore/database"
+	"safestore/rules"
+	"safestore/utils"
+
+	"gorm.io/gorm"
+)
+
+func PatchController(w http.ResponseWriter, r *http.Request, manager *utils.Manager) {
+	collection, id := parseDatabasePath(r)
+	if id == "" {
+		utils.FormatHttpError(w, http.StatusBadRequest, "Missing document id", "PATCH requires a document path")
+		return
+	}
+
+	// parse body to get the merge patch
+	var patch map[string]interface{}
+	err := utils.DecodeJSON(r.Body, &patch)
+	if err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Error parsing body")
+		return
+	}
+
+	ifVersion, err := parseIfMatch(r)
+	if err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Error parsing If-Match")
+		return
+	}
+
+	if !authorize(w, r, manager, rules.Write, documentRulePath(collection, id), patch) {
+		return
+	}
+
+	data, version, err := database.PatchInterface(manager.DB, collection, id, patch, ifVersion)
+	if errors.Is(err, database.ErrInvalidTransform) {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Invalid field transform")
+		return
+	}
+	if errors.Is(err, database.ErrVersionMismatch) {
+		utils.FormatHttpError(w, http.StatusPreconditionFailed, err.Error(), "Document was modified")
+		return
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		utils.FormatHttpError(w, http.StatusNotFound, err.Error(), "Document not found")
+		return
+	}
+	if err != nil {
+		utils.FormatHttpError(w, 500, err.Error(), "Error patching interface")
+		return
+	}
+	manager.PublishChange(utils.ChangeEvent{
+		Table:      utils.StoreRowsTable,
+		Op:         utils.UpdateOp,
+		Collection: collection,
+		ID:         id,
+		Data:       data,
+	})
+	setETag(w, version)
+	utils.FormatHttpSuccess(w, map[string]interface{}{"id": id, "collection": collection, "data": data, "version": version})
+}
@@ -0,0 +1,22 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// parseDatabasePath splits /database/{collection}/{id}/{subcollection}/... into the dotted
+// collection and the document id. An odd number of segments addresses a whole collection
+// and returns an empty id.
+func parseDatabasePath(r *http.Request) (string, string) {
+	return splitDatabasePath(strings.TrimPrefix(r.URL.Path, "/database/"))
+}
+
+func splitDatabasePath(path string) (string, string) {
+	urlPaths := strings.Split(path, "/")
+
+	if len(urlPaths)%2 == 0 {
+		return strings.Join(urlPaths[:len(urlPaths)-1], "."), urlPaths[len(urlPaths)-1]
+	}
+	return strings.Join(urlPaths, "."), ""
+}
@@ -1,16 +1,16 @@
 package controllers
 
 import (
-	"encoding/json"
+	"errors"
 	"net/http"
 	"safestore/database"
+	"safestore/rules"
 	"safestore/utils"
 	"strings"
-
-	"gorm.io/gorm"
 )
 
-func PostController(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
+func PostController(w http.ResponseWriter, r *http.Request, manager *utils.Manager) {
+	db := manager.DB
 	// get the collection from the URL
 	path := strings.TrimPrefix(r.URL.Path, "/database/")
 	urlPaths := strings.Split(path, "/")
@@ -21,19 +21,49 @@ func PostController(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 
 	// parse body to get the data
 	var data map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&data)
+	err := utils.DecodeJSON(r.Body, &data)
 
 	if err != nil {
 		utils.FormatHttpError(w, 500, err.Error(), "Error parsing body")
 		return
 	}
 
-	// update the current collection or override it
+	ifVersion, err := parseIfMatch(r)
+	if err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Error parsing If-Match")
+		return
+	}
+
+	if !authorize(w, r, manager, rules.Write, documentRulePath(collection, id), data) {
+		return
+	}
 
-	err = database.UpdateOrCreateInterface(db, collection, id, data)
+	// create the document or override it
+	result, err := database.UpdateOrCreateInterface(db, collection, id, data, ifVersion)
+	if errors.Is(err, database.ErrInvalidTransform) {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Invalid field transform")
+		return
+	}
+	if errors.Is(err, database.ErrVersionMismatch) {
+		utils.FormatHttpError(w, http.StatusPreconditionFailed, err.Error(), "Document was modified")
+		return
+	}
 	if err != nil {
 		utils.FormatHttpError(w, 500, err.Error(), "Error updating or creating interface")
 		return
 	}
-	utils.FormatHttpSuccess(w, map[string]interface{}{"id": id, "collection": collection, "data": data})
+
+	op, status := utils.UpdateOp, http.StatusOK
+	if result.Created {
+		op, status = utils.InsertOp, http.StatusCreated
+	}
+	manager.PublishChange(utils.ChangeEvent{
+		Table:      utils.StoreRowsTable,
+		Op:         op,
+		Collection: collection,
+		ID:         id,
+		Data:       result.Data,
+	})
+	setETag(w, result.Version)
+	utils.FormatHttpResponse(w, status, map[string]interface{}{"id": id, "collection": collection, "data": result.Data, "created": result.Created, "version": result.Version})
 }
@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"safestore/database"
+	"safestore/rules"
+	"safestore/utils"
+)
+
+func PutController(w http.ResponseWriter, r *http.Request, manager *utils.Manager) {
+	collection, id := parseDatabasePath(r)
+	if id == "" {
+		utils.FormatHttpError(w, http.StatusBadRequest, "Missing document id", "PUT requires a document path")
+		return
+	}
+
+	// parse body to get the data
+	var data map[string]interface{}
+	err := utils.DecodeJSON(r.Body, &data)
+	if err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Error parsing body")
+		return
+	}
+
+	ifVersion, err := parseIfMatch(r)
+	if err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Error parsing If-Match")
+		return
+	}
+
+	if !authorize(w, r, manager, rules.Write, documentRulePath(collection, id), data) {
+		return
+	}
+
+	// replace the whole document
+	result, err := database.UpdateOrCreateInterface(manager.DB, collection, id, data, ifVersion)
+	if errors.Is(err, database.ErrInvalidTransform) {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Invalid field transform")
+		return
+	}
+	if errors.Is(err, database.ErrVersionMismatch) {
+		utils.FormatHttpError(w, http.StatusPreconditionFailed, err.Error(), "Document was modified")
+		return
+	}
+	if err != nil {
+		utils.FormatHttpError(w, 500, err.Error(), "Error replacing interface")
+		return
+	}
+
+	op, status := utils.UpdateOp, http.StatusOK
+	if result.Created {
+		op, status = utils.InsertOp, http.StatusCreated
+	}
+	manager.PublishChange(utils.ChangeEvent{
+		Table:      utils.StoreRowsTable,
+		Op:         op,
+		Collection: collection,
+		ID:         id,
+		Data:       result.Data,
+	})
+	setETag(w, result.Version)
+	utils.FormatHttpResponse(w, status, map[string]interface{}{"id": id, "collection": collection, "data": result.Data, "version": result.Version})
+}
@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"safestore/database"
+	"safestore/rules"
+	"safestore/utils"
+	"strings"
+)
+
+// QuerySuffix marks a collection query: POST /database/{collection}:query
+const QuerySuffix = ":query"
+
+func QueryController(w http.ResponseWriter, r *http.Request, manager *utils.Manager) {
+	collection, id := splitDatabasePath(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/database/"), QuerySuffix))
+	if id != "" {
+		utils.FormatHttpError(w, http.StatusBadRequest, "Not a collection", "Queries run on a collection path")
+		return
+	}
+
+	// parse body to get the filters
+	var query database.Query
+	err := json.NewDecoder(r.Body).Decode(&query)
+	if err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Error parsing body")
+		return
+	}
+
+	if !authorize(w, r, manager, rules.Read, collectionRulePath(collection), nil) {
+		return
+	}
+
+	rows, err := database.SearchUsingJsonBPath(manager.DB, collection, query)
+	if err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Error querying collection")
+		return
+	}
+	data, err := database.DecodeRows(rows)
+	if err != nil {
+		utils.FormatHttpError(w, 500, err.Error(), "Error decoding documents")
+		return
+	}
+	utils.FormatHttpSuccess(w, data)
+}
@@ -0,0 +1,308 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"safestore/database"
+	"safestore/rules"
+	"safestore/utils"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+var upgrader = websocket.Upgrader{}
+
+func RealtimeController(w http.ResponseWriter, r *http.Request, manager *utils.Manager) {
+	protocol, err := utils.NegotiateProtocol(r)
+	if err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Supported protocols: "+strings.Join(utils.Subprotocols, ", "))
+		return
+	}
+	header := http.Header{}
+	if protocol != "" {
+		header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	c, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	userID, err := utils.GenerateRandomString()
+	if err != nil {
+		log.Println(err)
+		c.Close()
+		return
+	}
+
+	// once the read loop ends, the client is dropped with its subscriptions, groups and live queries,
+	// it writes its queued messages then closes the connection
+	manager.WebsocketManager.Heartbeat.Watch(c)
+	client := manager.WebsocketManager.AddClient(userID, c)
+	defer manager.WebsocketManager.RemoveClient(userID)
+	defer manager.WebsocketManager.RequireAuth(userID, client)()
+	defer manager.LiveQueries.RemoveClient(userID)
+outer:
+	for {
+		request, err := utils.ReadEnvelope(c)
+		var protocolErr *utils.ProtocolError
+		if errors.As(err, &protocolErr) {
+			replyError(client, utils.Envelope{Op: utils.ErrorOp}, protocolErr.Code, protocolErr.Message)
+			if protocolErr.CloseCode != 0 {
+				client.CloseWithReason(protocolErr.CloseCode, protocolErr.Message)
+				break
+			}
+			continue
+		}
+		if err != nil {
+			// a closed tab or a dead connection past its pong timeout
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println("read:", err)
+			}
+			break
+		}
+
+		// every operation but the authentication requires an authenticated connection
+		if request.Op != utils.AuthOp && manager.WebsocketManager.Identity(userID) == nil {
+			replyError(client, request, http.StatusUnauthorized, "Unauthorized")
+			continue
+		}
+
+		payload, err := request.DecodePayload()
+		if errors.As(err, &protocolErr) {
+			replyError(client, request, protocolErr.Code, protocolErr.Message)
+			continue
+		}
+
+		switch request.Op {
+		case utils.AuthOp: // Authentication operation
+			authPayload := payload.(*utils.AuthPayload)
+			identity, err := manager.Authenticator.Authenticate(authPayload.Credentials())
+			if err == nil {
+				manager.WebsocketManager.SetIdentity(userID, identity)
+				reply(client, request, utils.AuthOp, "Authorized")
+			} else if manager.WebsocketManager.Identity(userID) != nil {
+				// a failed reauthentication keeps the connection and its previous identity
+				replyError(client, request, http.StatusUnauthorized, "Unauthorized")
+			} else {
+				replyError(client, request, http.StatusUnauthorized, "Unauthorized")
+				client.CloseWithReason(websocket.ClosePolicyViolation, "Unauthorized")
+				break outer
+			}
+			continue
+		case utils.InsertOp: // Insert operation in the database
+			crudPayload := payload.(*utils.CrudPayload)
+			if !authorizeRealtime(manager, userID, rules.Write, crudPayload.Path, crudPayload.Data) {
+				replyError(client, request, http.StatusForbidden, "Permission denied")
+				continue
+			}
+			var paths []map[string]interface{}
+			utils.GeneratePaths(crudPayload.Data, database.TreePathToLTree(crudPayload.Path), &paths)
+			err = database.InsertInSafeRow(manager.DB, &paths)
+			if err != nil {
+				log.Println(err)
+				replyError(client, request, errorCode(err), err.Error())
+				continue
+			}
+			event := utils.ChangeEvent{
+				Table: utils.SafeRowsTable,
+				Op:    utils.InsertOp,
+				Path:  database.TreePathToLTree(crudPayload.Path),
+				Data:  crudPayload.Data,
+			}
+			if utils.HasTransforms(paths) {
+				event.Data, event.Truncated = nil, true
+			}
+			manager.PublishChange(event)
+		case utils.DeleteOp: // Delete operation in the database
+			crudPayload := payload.(*utils.CrudPayload)
+			if !authorizeRealtime(manager, userID, rules.Write, crudPayload.Path, nil) {
+				replyError(client, request, http.StatusForbidden, "Permission denied")
+				continue
+			}
+			path := database.TreePathToLTree(crudPayload.Path)
+			err := database.DeleteInSafeRow(manager.DB, &path)
+			if err != nil {
+				replyError(client, request, errorCode(err), err.Error())
+				continue
+			}
+			manager.PublishChange(utils.ChangeEvent{
+				Table: utils.SafeRowsTable,
+				Op:    utils.DeleteOp,
+				Path:  path,
+			})
+		case utils.UpdateOp: // Merge the data into the existing subtree, null deleting a child
+			crudPayload := payload.(*utils.CrudPayload)
+			if !authorizeRealtime(manager, userID, rules.Write, crudPayload.Path, crudPayload.Data) {
+				replyError(client, request, http.StatusForbidden, "Permission denied")
+				continue
+			}
+			if err := mergeTree(manager, database.TreePathToLTree(crudPayload.Path), crudPayload.Data); err != nil {
+				log.Println(err)
+				replyError(client, request, errorCode(err), err.Error())
+				continue
+			}
+		case utils.GetOp:
+			crudPayload := payload.(*utils.CrudPayload)
+			if !authorizeRealtime(manager, userID, rules.Read, crudPayload.Path, nil) {
+				replyError(client, request, http.StatusForbidden, "Permission denied")
+				continue
+			}
+			options := database.TreeReadOptions{Shallow: crudPayload.Shallow, Depth: crudPayload.Depth}
+			data, _, err := database.ReadTree(manager.DB, database.TreePathToLTree(crudPayload.Path), options)
+			if err != nil {
+				replyError(client, request, errorCode(err), err.Error())
+				continue
+			}
+			reply(client, request, utils.GetOp, data)
+			continue
+		case utils.SubscribeOp: // Listen to every change under a path prefix
+			subscription := payload.(*utils.SubscriptionPayload)
+			if !authorizeRealtime(manager, userID, rules.Read, subscription.Path, nil) {
+				replyError(client, request, http.StatusForbidden, "Permission denied")
+				continue
+			}
+			manager.WebsocketManager.Subscribe(userID, database.TreePathToLTree(subscription.Path))
+		case utils.UnsubscribeOp:
+			subscription := payload.(*utils.SubscriptionPayload)
+			manager.WebsocketManager.Unsubscribe(userID, database.TreePathToLTree(subscription.Path))
+		case utils.DocumentSubscribeOp: // Listen to the changes of a collection or a document
+			subscription := payload.(*utils.DocumentSubscriptionPayload)
+			collection := database.PathToLTree(subscription.Collection)
+			rulePath := collectionRulePath(collection)
+			if subscription.ID != "" {
+				rulePath = documentRulePath(collection, subscription.ID)
+			}
+			if !manager.Authorize(manager.WebsocketManager.Identity(userID), rules.Read, rulePath, nil) {
+				replyError(client, request, http.StatusForbidden, "Permission denied")
+				continue
+			}
+			manager.WebsocketManager.SubscribeDocuments(userID, collection, subscription.ID)
+		case utils.DocumentUnsubscribeOp:
+			subscription := payload.(*utils.DocumentSubscriptionPayload)
+			manager.WebsocketManager.UnsubscribeDocuments(userID, database.PathToLTree(subscription.Collection), subscription.ID)
+		case utils.LiveQueryOp: // Run a query and stream the changes of its result set
+			liveQuery := payload.(*utils.LiveQueryPayload)
+			if !manager.Authorize(manager.WebsocketManager.Identity(userID), rules.Read, collectionRulePath(liveQuery.Collection), nil) {
+				replyError(client, request, http.StatusForbidden, "Permission denied")
+				continue
+			}
+			err := manager.LiveQueries.Register(manager.DB, userID, *liveQuery, func(result *utils.LiveQueryResult) {
+				reply(client, request, utils.LiveQueryResultOp, result)
+			})
+			if err != nil {
+				replyError(client, request, errorCode(err), err.Error())
+			}
+			continue
+		case utils.LiveQueryStopOp:
+			liveQuery := payload.(*utils.LiveQueryPayload)
+			manager.LiveQueries.Unregister(userID, liveQuery.QueryID)
+		case utils.MultiUpdateOp: // Write several paths atomically
+			update := payload.(*utils.MultiUpdatePayload)
+			allowed := true
+			for path, value := range update.Updates {
+				if !authorizeRealtime(manager, userID, rules.Write, path, value) {
+					allowed = false
+					break
+				}
+			}
+			if !allowed {
+				replyError(client, request, http.StatusForbidden, "Permission denied")
+				continue
+			}
+
+			roots, paths := utils.GenerateUpdatePaths(update.Updates)
+			err := database.UpdateSafeRowPaths(manager.DB, roots, &paths)
+			if err != nil {
+				log.Println(err)
+				replyError(client, request, errorCode(err), err.Error())
+				continue
+			}
+			data := make(map[string]interface{}, len(update.Updates))
+			for path, value := range update.Updates {
+				data[database.TreePathToLTree(path)] = value
+			}
+			event := utils.ChangeEvent{
+				Table: utils.SafeRowsTable,
+				Op:    utils.MultiUpdateOp,
+				Paths: roots,
+				Data:  data,
+			}
+			if utils.HasTransforms(paths) {
+				event.Data, event.Truncated = nil, true
+			}
+			manager.PublishChange(event)
+		case utils.TransactionReadOp: // Read documents with their versions
+			read := payload.(*utils.TransactionReadPayload)
+			documents, err := readTransactionDocuments(manager, manager.WebsocketManager.Identity(userID), read.Documents)
+			if err != nil {
+				replyError(client, request, errorCode(err), err.Error())
+				continue
+			}
+			reply(client, request, utils.TransactionReadOp, documents)
+			continue
+		case utils.TransactionCommitOp: // Commit writes if the read documents did not change
+			transaction := payload.(*database.Transaction)
+			results, err := commitTransaction(manager, manager.WebsocketManager.Identity(userID), *transaction)
+			if err != nil {
+				replyError(client, request, errorCode(err), err.Error())
+				continue
+			}
+			reply(client, request, utils.TransactionCommitOp, map[string]interface{}{"results": results})
+			continue
+		case utils.TreeQueryOp: // Query the ordered children of a node of the tree
+			query := payload.(*utils.TreeQueryPayload)
+			if !authorizeRealtime(manager, userID, rules.Read, query.Path, nil) {
+				replyError(client, request, http.StatusForbidden, "Permission denied")
+				continue
+			}
+			children, err := database.QueryTree(manager.DB, database.TreePathToLTree(query.Path), query.TreeQuery)
+			if err != nil {
+				replyError(client, request, errorCode(err), err.Error())
+				continue
+			}
+			reply(client, request, utils.TreeQueryOp, map[string]interface{}{"path": query.Path, "children": children})
+			continue
+		}
+		// acknowledge the request without echoing its payload
+		reply(client, request, request.Op, nil)
+	}
+}
+
+// reply sends the result of a request to the requesting connection only, tagged with the id the client chose
+func reply(client *utils.Client, request utils.Envelope, op utils.OpEnum, data interface{}) {
+	if err := client.Send(utils.WebSocketQuery{Op: op, ID: request.ID, Data: data}); err != nil {
+		log.Println("write:", err)
+	}
+}
+
+// replyError sends the failure of a request to the requesting connection only, code follows the HTTP status codes
+func replyError(client *utils.Client, request utils.Envelope, code int, message string) {
+	err := client.Send(utils.WebSocketQuery{
+		Op:    request.Op,
+		ID:    request.ID,
+		Error: &utils.ReplyError{Code: code, Message: message},
+	})
+	if err != nil {
+		log.Println("write:", err)
+	}
+}
+
+// errorCode returns the status code matching an error of the database layer
+func errorCode(err error) int {
+	switch {
+	case errors.Is(err, errPermissionDenied):
+		return http.StatusForbidden
+	case errors.Is(err, database.ErrVersionMismatch):
+		return http.StatusConflict
+	case errors.Is(err, database.ErrInvalidTransform), errors.Is(err, database.ErrInvalidTreeQuery),
+		errors.Is(err, database.ErrInvalidCursor), errors.Is(err, database.ErrInvalidPage),
+		errors.Is(err, database.ErrOverlappingPaths):
+		return http.StatusBadRequest
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
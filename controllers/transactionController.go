@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"safestore/database"
+	"safestore/rules"
+	"safestore/utils"
+)
+
+var errPermissionDenied = errors.New("permission denied")
+
+// TransactionReadController returns the data and version of the requested documents,
+// the versions are then sent back as the reads of TransactionCommitController
+func TransactionReadController(w http.ResponseWriter, r *http.Request, manager *utils.Manager) {
+	var payload utils.TransactionReadPayload
+	if err := utils.DecodeJSON(r.Body, &payload); err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Error parsing body")
+		return
+	}
+	identity, err := manager.AuthenticateRequest(r)
+	if err != nil {
+		utils.FormatHttpError(w, http.StatusUnauthorized, "Unauthorized", err.Error())
+		return
+	}
+
+	documents, err := readTransactionDocuments(manager, identity, payload.Documents)
+	if errors.Is(err, errPermissionDenied) {
+		utils.FormatHttpError(w, http.StatusForbidden, "Forbidden", err.Error())
+		return
+	}
+	if err != nil {
+		utils.FormatHttpError(w, 500, err.Error(), "Error reading documents")
+		return
+	}
+	utils.FormatHttpSuccess(w, documents)
+}
+
+// TransactionCommitController applies the writes of a transaction if none of its reads changed
+func TransactionCommitController(w http.ResponseWriter, r *http.Request, manager *utils.Manager) {
+	var transaction database.Transaction
+	if err := utils.DecodeJSON(r.Body, &transaction); err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Error parsing body")
+		return
+	}
+	identity, err := manager.AuthenticateRequest(r)
+	if err != nil {
+		utils.FormatHttpError(w, http.StatusUnauthorized, "Unauthorized", err.Error())
+		return
+	}
+
+	results, err := commitTransaction(manager, identity, transaction)
+	if errors.Is(err, errPermissionDenied) {
+		utils.FormatHttpError(w, http.StatusForbidden, "Forbidden", err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrVersionMismatch) {
+		utils.FormatHttpError(w, http.StatusConflict, err.Error(), "A read document was modified, retry the transaction")
+		return
+	}
+	if err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Error committing transaction")
+		return
+	}
+	utils.FormatHttpSuccess(w, map[string]interface{}{"results": results})
+}
+
+func readTransactionDocuments(manager *utils.Manager, identity *utils.Identity, refs []database.DocumentRef) ([]database.VersionedDocument, error) {
+	for i := range refs {
+		refs[i].Collection = database.PathToLTree(refs[i].Collection)
+		if !manager.Authorize(identity, rules.Read, documentRulePath(refs[i].Collection, refs[i].ID), nil) {
+			return nil, errPermissionDenied
+		}
+	}
+	return database.ReadDocuments(manager.DB, refs)
+}
+
+// commitTransaction checks the security rules of every document of the transaction,
+// commits it and publishes the change of each written document
+func commitTransaction(manager *utils.Manager, identity *utils.Identity, transaction database.Transaction) ([]database.TransactionResult, error) {
+	for i := range transaction.Reads {
+		read := &transaction.Reads[i]
+		read.Collection = database.PathToLTree(read.Collection)
+		if !manager.Authorize(identity, rules.Read, documentRulePath(read.Collection, read.ID), nil) {
+			return nil, errPermissionDenied
+		}
+	}
+	for i := range transaction.Writes {
+		write := &transaction.Writes[i]
+		write.Collection = database.PathToLTree(write.Collection)
+		if !manager.Authorize(identity, rules.Write, documentRulePath(write.Collection, write.ID), write.Data) {
+			return nil, errPermissionDenied
+		}
+	}
+
+	results, err := database.CommitTransaction(manager.DB, transaction)
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		event := utils.ChangeEvent{
+			Table:      utils.StoreRowsTable,
+			Op:         utils.UpdateOp,
+			Collection: result.Collection,
+			ID:         result.ID,
+			Data:       result.Data,
+		}
+		if result.Created {
+			event.Op = utils.InsertOp
+		} else if result.Op == database.TransactionDelete {
+			event.Op = utils.DeleteOp
+		}
+		manager.PublishChange(event)
+	}
+	return results, nil
+}
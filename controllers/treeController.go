@@ -0,0 +1,272 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"safestore/database"
+	"safestore/rules"
+	"safestore/utils"
+	"strconv"
+	"strings"
+)
+
+// TreePrefix is the URL prefix of the SafeRow tree endpoints, followed by the slash separated keys
+const TreePrefix = "/tree"
+
+// parseTreePath returns the slash separated client path and the ltree path of a /tree/{path...} request
+func parseTreePath(r *http.Request) (string, string) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, TreePrefix), "/")
+	return path, database.TreePathToLTree(path)
+}
+
+// parseTreeReadOptions reads the shallow=true and depth=N query parameters of a tree read
+func parseTreeReadOptions(r *http.Request) (database.TreeReadOptions, error) {
+	var options database.TreeReadOptions
+	var err error
+	params := r.URL.Query()
+	if raw := params.Get("shallow"); raw != "" {
+		if options.Shallow, err = strconv.ParseBool(raw); err != nil {
+			return options, fmt.Errorf("shallow must be a boolean")
+		}
+	}
+	if raw := params.Get("depth"); raw != "" {
+		if options.Depth, err = strconv.Atoi(raw); err != nil || options.Depth < 1 {
+			return options, fmt.Errorf("depth must be a positive integer")
+		}
+	}
+	if options.Shallow && options.Depth != 0 {
+		return options, fmt.Errorf("shallow and depth cannot be combined")
+	}
+	return options, nil
+}
+
+// parseTreeQuery reads the orderByChild, orderByKey, startAt, endAt, limitToFirst and limitToLast
+// query parameters, it returns nil when none of them is set. The bounds are JSON values,
+// a bound which is not valid JSON is taken as a string.
+func parseTreeQuery(r *http.Request) (*database.TreeQuery, error) {
+	params := r.URL.Query()
+	query := &database.TreeQuery{}
+	var set bool
+	var err error
+	if raw := params.Get("orderByChild"); raw != "" {
+		query.OrderByChild, set = raw, true
+	}
+	if raw := params.Get("orderByKey"); raw != "" {
+		if query.OrderByKey, err = strconv.ParseBool(raw); err != nil {
+			return nil, fmt.Errorf("orderByKey must be a boolean")
+		}
+		set = true
+	}
+	for name, bound := range map[string]*interface{}{"startAt": &query.StartAt, "endAt": &query.EndAt} {
+		raw := params.Get(name)
+		if raw == "" {
+			continue
+		}
+		if err := utils.DecodeJSON(strings.NewReader(raw), bound); err != nil {
+			*bound = raw
+		}
+		set = true
+	}
+	for name, limit := range map[string]*int{"limitToFirst": &query.LimitToFirst, "limitToLast": &query.LimitToLast} {
+		raw := params.Get(name)
+		if raw == "" {
+			continue
+		}
+		if *limit, err = strconv.Atoi(raw); err != nil || *limit < 1 {
+			return nil, fmt.Errorf("%s must be a positive integer", name)
+		}
+		set = true
+	}
+	if !set {
+		return nil, nil
+	}
+	return query, nil
+}
+
+func TreeGetController(w http.ResponseWriter, r *http.Request, manager *utils.Manager) {
+	path, ltreePath := parseTreePath(r)
+	options, err := parseTreeReadOptions(r)
+	if err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Invalid read options")
+		return
+	}
+	query, err := parseTreeQuery(r)
+	if err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Invalid query")
+		return
+	}
+	if query != nil && (options.Shallow || options.Depth != 0) {
+		utils.FormatHttpError(w, http.StatusBadRequest, "Invalid query", "A query cannot be combined with shallow or depth")
+		return
+	}
+	if !authorize(w, r, manager, rules.Read, treeRulePath(path), nil) {
+		return
+	}
+
+	if query != nil {
+		children, err := database.QueryTree(manager.DB, ltreePath, *query)
+		if errors.Is(err, database.ErrInvalidTreeQuery) {
+			utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Invalid query")
+			return
+		}
+		if err != nil {
+			utils.FormatHttpError(w, 500, err.Error(), "Error querying tree")
+			return
+		}
+		utils.FormatHttpSuccess(w, map[string]interface{}{"children": children})
+		return
+	}
+
+	data, found, err := database.ReadTree(manager.DB, ltreePath, options)
+	if err != nil {
+		utils.FormatHttpError(w, 500, err.Error(), "Error reading tree")
+		return
+	}
+	if !found {
+		utils.FormatHttpError(w, http.StatusNotFound, "Not found", "Nothing is stored at "+path)
+		return
+	}
+	utils.FormatHttpSuccess(w, data)
+}
+
+// TreePutController replaces the value stored at the path, a null body deletes it
+func TreePutController(w http.ResponseWriter, r *http.Request, manager *utils.Manager) {
+	path, ltreePath := parseTreePath(r)
+
+	var data interface{}
+	if err := utils.DecodeJSON(r.Body, &data); err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Error parsing body")
+		return
+	}
+	if _, ok := data.(map[string]interface{}); !ok && ltreePath == "" {
+		utils.FormatHttpError(w, http.StatusBadRequest, "Invalid body", "The root of the tree can only hold an object")
+		return
+	}
+
+	if !authorize(w, r, manager, rules.Write, treeRulePath(path), data) {
+		return
+	}
+
+	roots, paths := utils.GenerateUpdatePaths(map[string]interface{}{path: data})
+	err := database.UpdateSafeRowPaths(manager.DB, roots, &paths)
+	if errors.Is(err, database.ErrInvalidTransform) {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Invalid field transform")
+		return
+	}
+	if err != nil {
+		utils.FormatHttpError(w, 500, err.Error(), "Error writing tree")
+		return
+	}
+
+	// the value replaces the whole subtree, a subscriber below the path receives its own part, null once removed
+	event := utils.ChangeEvent{
+		Table: utils.SafeRowsTable,
+		Op:    utils.InsertOp,
+		Paths: roots,
+		Data:  map[string]interface{}{ltreePath: data},
+	}
+	if data == nil {
+		event.Op = utils.DeleteOp
+	}
+	if utils.HasTransforms(paths) {
+		event.Data, event.Truncated = nil, true
+	}
+	manager.PublishChange(event)
+	writeTree(w, manager, ltreePath)
+}
+
+// TreePatchController deep merges the body into the value stored at the path, a null child deleting it
+// like the UpdateOp of the websocket
+func TreePatchController(w http.ResponseWriter, r *http.Request, manager *utils.Manager) {
+	path, ltreePath := parseTreePath(r)
+
+	var data map[string]interface{}
+	if err := utils.DecodeJSON(r.Body, &data); err != nil {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Error parsing body")
+		return
+	}
+
+	if !authorize(w, r, manager, rules.Write, treeRulePath(path), data) {
+		return
+	}
+
+	err := mergeTree(manager, ltreePath, data)
+	if errors.Is(err, database.ErrInvalidTransform) {
+		utils.FormatHttpError(w, http.StatusBadRequest, err.Error(), "Invalid field transform")
+		return
+	}
+	if err != nil {
+		utils.FormatHttpError(w, 500, err.Error(), "Error writing tree")
+		return
+	}
+	writeTree(w, manager, ltreePath)
+}
+
+func TreeDeleteController(w http.ResponseWriter, r *http.Request, manager *utils.Manager) {
+	path, ltreePath := parseTreePath(r)
+	if !authorize(w, r, manager, rules.Write, treeRulePath(path), nil) {
+		return
+	}
+
+	if err := database.DeleteInSafeRow(manager.DB, &ltreePath); err != nil {
+		utils.FormatHttpError(w, 500, err.Error(), "Error deleting tree")
+		return
+	}
+
+	publishTreeChange(manager, utils.DeleteOp, ltreePath, nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mergeTree deep merges the data into the subtree at the ltree path, a null child deleting it,
+// and publishes the merged children. It backs the websocket UpdateOp and the tree PATCH.
+func mergeTree(manager *utils.Manager, path string, data map[string]interface{}) error {
+	changes, paths := utils.GenerateMergePaths(path, data)
+	if len(changes) == 0 {
+		return nil
+	}
+	roots := make([]string, 0, len(changes))
+	for root := range changes {
+		roots = append(roots, root)
+	}
+	if err := database.UpdateSafeRowPaths(manager.DB, roots, &paths); err != nil {
+		return err
+	}
+
+	// only the merged children are sent to the subscribers
+	event := utils.ChangeEvent{
+		Table: utils.SafeRowsTable,
+		Op:    utils.UpdateOp,
+		Paths: roots,
+		Data:  changes,
+	}
+	if utils.HasTransforms(paths) {
+		event.Data, event.Truncated = nil, true
+	}
+	manager.PublishChange(event)
+	return nil
+}
+
+// publishTreeChange notifies the subscribers of the path, like the websocket writes do
+func publishTreeChange(manager *utils.Manager, op utils.OpEnum, path string, data interface{}, paths []map[string]interface{}) {
+	event := utils.ChangeEvent{
+		Table: utils.SafeRowsTable,
+		Op:    op,
+		Path:  path,
+		Data:  data,
+	}
+	if utils.HasTransforms(paths) {
+		event.Data, event.Truncated = nil, true
+	}
+	manager.PublishChange(event)
+}
+
+// writeTree responds with the value stored at the path once written, with its transforms resolved
+func writeTree(w http.ResponseWriter, manager *utils.Manager, path string) {
+	data, _, err := database.ReadSubtree(manager.DB, path)
+	if err != nil {
+		utils.FormatHttpError(w, 500, err.Error(), "Error reading tree")
+		return
+	}
+	utils.FormatHttpSuccess(w, data)
+}
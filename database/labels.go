@@ -0,0 +1,95 @@
+package database
+
+import (
+	"strings"
+)
+
+// emptyLabel stands for the empty key, ltree labels cannot be empty. It escapes '0', which
+// EncodeLabel always keeps as is, so no other key is encoded into it.
+const emptyLabel = "_30"
+
+// EncodeLabel escapes a JSON object key into a valid ltree label. Letters and digits are kept,
+// any other byte is written as _XX, XX being its upper case hex value. An underscore is kept as is
+// unless it is followed by two upper case hex digits, so that common keys like first_name are unchanged.
+func EncodeLabel(key string) string {
+	if key == "" {
+		return emptyLabel
+	}
+	var label strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case isLabelChar(c):
+			label.WriteByte(c)
+		case c == '_' && !(i+2 < len(key) && isUpperHex(key[i+1]) && isUpperHex(key[i+2])):
+			label.WriteByte(c)
+		default:
+			label.WriteByte('_')
+			label.WriteByte(upperHex[c>>4])
+			label.WriteByte(upperHex[c&0x0f])
+		}
+	}
+	return label.String()
+}
+
+// DecodeLabel returns the key escaped by EncodeLabel
+func DecodeLabel(label string) string {
+	if label == emptyLabel {
+		return ""
+	}
+	if !strings.Contains(label, "_") {
+		return label
+	}
+	key := make([]byte, 0, len(label))
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if c == '_' && i+2 < len(label) && isUpperHex(label[i+1]) && isUpperHex(label[i+2]) {
+			key = append(key, unhex(label[i+1])<<4|unhex(label[i+2]))
+			i += 2
+			continue
+		}
+		key = append(key, c)
+	}
+	return string(key)
+}
+
+// TreePathToLTree converts a slash separated path of the SafeRow tree (`rooms/42/first name`)
+// into its ltree notation, each segment being a raw key escaped by EncodeLabel
+func TreePathToLTree(path string) string {
+	labels := make([]string, 0)
+	for _, key := range strings.Split(path, "/") {
+		if key != "" {
+			labels = append(labels, EncodeLabel(key))
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// LTreeToTreePath converts an ltree path of the SafeRow tree back into its slash separated keys
+func LTreeToTreePath(path string) string {
+	if path == "" {
+		return ""
+	}
+	labels := strings.Split(path, ".")
+	for i, label := range labels {
+		labels[i] = DecodeLabel(label)
+	}
+	return strings.Join(labels, "/")
+}
+
+const upperHex = "0123456789ABCDEF"
+
+func isLabelChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func isUpperHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	if c <= '9' {
+		return c - '0'
+	}
+	return c - 'A' + 10
+}
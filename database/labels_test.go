@@ -0,0 +1,111 @@
+package database
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeLabel(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"name", "name"},
+		{"Room42", "Room42"},
+		{"first_name", "first_name"},
+		{"_", "_"},
+		{"", emptyLabel},
+		{"\x00", "_00"},
+		{"_00", "_5F00"},
+		{"_5F", "_5F5F"},
+		{"_0", "_0"},
+		{"_0a", "_0a"},
+		{"first name", "first_20name"},
+		{"a.b", "a_2Eb"},
+		{"a/b", "a_2Fb"},
+		{"é", "_C3_A9"},
+	}
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			if got := EncodeLabel(test.key); got != test.expected {
+				t.Fatalf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestLabelRoundTrip(t *testing.T) {
+	keys := []string{
+		"", "\x00", "0", "_", "__", "_30", "_00", "_5F", "_5F5F", "_ab", "_AB", "_A", "a_",
+		"first_name", "first name", "a.b", "a/b", "é", "🙂", "\xff", "x_2E", "_2E_2E",
+	}
+	labels := make(map[string]string, len(keys))
+	for _, key := range keys {
+		label := EncodeLabel(key)
+		if label == "" {
+			t.Fatalf("%q encoded into an empty label", key)
+		}
+		for i := 0; i < len(label); i++ {
+			if !isLabelChar(label[i]) && label[i] != '_' {
+				t.Fatalf("%q encoded into %q, which is not a valid ltree label", key, label)
+			}
+		}
+		if other, ok := labels[label]; ok {
+			t.Fatalf("%q and %q are both encoded into %q", other, key, label)
+		}
+		labels[label] = key
+		if decoded := DecodeLabel(label); decoded != key {
+			t.Fatalf("%q encoded into %q decoded into %q", key, label, decoded)
+		}
+	}
+}
+
+func TestTreePathToLTree(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"", ""},
+		{"rooms", "rooms"},
+		{"/rooms/42/", "rooms.42"},
+		{"rooms/first name/a.b", "rooms.first_20name.a_2Eb"},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			ltree := TreePathToLTree(test.path)
+			if ltree != test.expected {
+				t.Fatalf("expected %q, got %q", test.expected, ltree)
+			}
+			if back := LTreeToTreePath(ltree); back != strings.Trim(test.path, "/") {
+				t.Fatalf("expected %q back, got %q", strings.Trim(test.path, "/"), back)
+			}
+		})
+	}
+}
+
+// TestLabelsAreDistinct encodes every key of up to 4 bytes made of the characters taking part in escapes
+func TestLabelsAreDistinct(t *testing.T) {
+	alphabet := []byte{'_', '0', '3', '5', 'F', 'a', ' ', 0}
+	keys := []string{""}
+	for previous := keys; len(previous[0]) < 4; {
+		next := make([]string, 0, len(previous)*len(alphabet))
+		for _, key := range previous {
+			for _, c := range alphabet {
+				next = append(next, key+string(c))
+			}
+		}
+		keys = append(keys, next...)
+		previous = next
+	}
+	labels := make(map[string]string, len(keys))
+	for _, key := range keys {
+		label := EncodeLabel(key)
+		if other, ok := labels[label]; ok {
+			t.Fatalf("%q and %q are both encoded into %q", other, key, label)
+		}
+		labels[label] = key
+		if decoded := DecodeLabel(label); decoded != key {
+			t.Fatalf("%q encoded into %q decoded into %q", key, label, decoded)
+		}
+	}
+}
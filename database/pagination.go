@@ -0,0 +1,211 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OrderByID orders documents by their collection id instead of a JSON field
+const OrderByID = "collection_id"
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ErrInvalidPage is returned when the options of a Page cannot be combined or are out of range
+var ErrInvalidPage = errors.New("invalid page")
+
+// Page describes the slice of an ordered collection to read
+type Page struct {
+	// OrderBy is a dotted JSON field or OrderByID, ties are always broken by collection id
+	OrderBy    string
+	Descending bool
+	Limit      int
+	// StartAfter and EndBefore are cursors returned by a previous page
+	StartAfter string
+	EndBefore  string
+}
+
+type Document struct {
+	ID   string                 `json:"id"`
+	Data map[string]interface{} `json:"data"`
+}
+
+type PageResult struct {
+	Documents []Document `json:"documents"`
+	// NextCursor is set when documents follow the page, pass it as StartAfter
+	NextCursor string `json:"nextCursor,omitempty"`
+	// PreviousCursor is set when documents precede the page, pass it as EndBefore
+	PreviousCursor string `json:"previousCursor,omitempty"`
+}
+
+type cursor struct {
+	OrderBy string          `json:"o"`
+	Value   json.RawMessage `json:"v,omitempty"`
+	ID      string          `json:"id"`
+}
+
+// GetCollectionPage reads one ordered page of the documents of a collection matching the query
+func GetCollectionPage(db *gorm.DB, collection string, query Query, page Page) (*PageResult, error) {
+	if page.OrderBy == "" {
+		page.OrderBy = OrderByID
+	}
+	if page.Limit <= 0 {
+		return nil, fmt.Errorf("%w: limit must be positive", ErrInvalidPage)
+	}
+	if page.StartAfter != "" && page.EndBefore != "" {
+		return nil, fmt.Errorf("%w: startAfter and endBefore cannot be combined", ErrInvalidPage)
+	}
+
+	finalQuery, err := ApplyFilters(db.Where("path = ?", collection), query)
+	if err != nil {
+		return nil, err
+	}
+
+	// read the rows preceding EndBefore in reverse order, then restore the requested order
+	backward := page.EndBefore != ""
+	descending := page.Descending != backward
+
+	orderValue := "collection_id"
+	var orderVars []interface{}
+	if page.OrderBy != OrderByID {
+		orderValue = "COALESCE(data #> ?::text[], 'null'::jsonb)"
+		orderVars = []interface{}{pq.StringArray(jsonFieldPath(page.OrderBy))}
+	}
+
+	if page.StartAfter != "" || page.EndBefore != "" {
+		raw := page.StartAfter
+		if backward {
+			raw = page.EndBefore
+		}
+		c, err := decodeCursor(raw, page.OrderBy)
+		if err != nil {
+			return nil, err
+		}
+		comparison := ">"
+		if descending {
+			comparison = "<"
+		}
+		if page.OrderBy == OrderByID {
+			finalQuery = finalQuery.Where("collection_id "+comparison+" ?", c.ID)
+		} else {
+			vars := append(orderVars, string(c.Value), c.ID)
+			finalQuery = finalQuery.Where("("+orderValue+", collection_id) "+comparison+" (?::jsonb, ?)", vars...)
+		}
+	}
+
+	direction := "ASC"
+	if descending {
+		direction = "DESC"
+	}
+	orderSQL := orderValue + " " + direction + ", collection_id " + direction
+	if page.OrderBy == OrderByID {
+		orderSQL = "collection_id " + direction
+	}
+
+	var rows []StoreRow
+	err = finalQuery.
+		Order(clause.OrderBy{Expression: clause.Expr{SQL: orderSQL, Vars: orderVars, WithoutParentheses: true}}).
+		Limit(page.Limit + 1).
+		Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	hasMore := len(rows) > page.Limit
+	if hasMore {
+		rows = rows[:page.Limit]
+	}
+	if backward {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	result := &PageResult{Documents: make([]Document, 0, len(rows))}
+	for _, row := range rows {
+		var data map[string]interface{}
+		if err := decodeJSON(row.Data, &data); err != nil {
+			return nil, err
+		}
+		result.Documents = append(result.Documents, Document{ID: row.CollectionId, Data: data})
+	}
+	if len(result.Documents) == 0 {
+		return result, nil
+	}
+
+	first, last := result.Documents[0], result.Documents[len(result.Documents)-1]
+	if backward {
+		// the EndBefore document itself follows the page
+		if result.NextCursor, err = encodeCursor(last, page.OrderBy); err != nil {
+			return nil, err
+		}
+		if hasMore {
+			if result.PreviousCursor, err = encodeCursor(first, page.OrderBy); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if hasMore {
+			if result.NextCursor, err = encodeCursor(last, page.OrderBy); err != nil {
+				return nil, err
+			}
+		}
+		if page.StartAfter != "" {
+			if result.PreviousCursor, err = encodeCursor(first, page.OrderBy); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func encodeCursor(document Document, orderBy string) (string, error) {
+	c := cursor{OrderBy: orderBy, ID: document.ID}
+	if orderBy != OrderByID {
+		value, err := json.Marshal(lookupField(document.Data, orderBy))
+		if err != nil {
+			return "", err
+		}
+		c.Value = value
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(raw string, orderBy string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &cursor{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	// a cursor only makes sense for the ordering it was created with
+	if c.OrderBy != orderBy || (orderBy != OrderByID && len(c.Value) == 0) {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// lookupField returns the value of a dotted JSON field, nil when it does not exist
+func lookupField(data map[string]interface{}, field string) interface{} {
+	var current interface{} = data
+	for _, key := range strings.Split(field, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = object[key]
+	}
+	return current
+}
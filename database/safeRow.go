@@ -2,8 +2,11 @@ package database
 
 import (
 	"database/sql/driver"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,17 +18,39 @@ import (
 type SafeRow struct {
 	Path             LTree          `gorm:"type:ltree;primaryKey;index:idx_path_gist,type:gist" json:"path"`
 	Int              *int32         `gorm:"column:int_value" json:"int_value"`
+	BigInt           *int64         `gorm:"column:bigint_value" json:"bigint_value"`
+	Float            *float64       `gorm:"column:float_value;type:double precision" json:"float_value"`
+	Numeric          *Decimal       `gorm:"column:numeric_value;type:numeric" json:"numeric_value"`
 	Text             *string        `gorm:"column:text_value" json:"text_value"`
+	UUID             *string        `gorm:"column:uuid_value;type:uuid" json:"uuid_value"`
 	CollectionString pq.StringArray `gorm:"type:text[];column:collection_string" json:"collection_string"`
 	CollectionInt    pq.Int32Array  `gorm:"type:integer[];column:collection_int" json:"collection_int"`
 	Timestamp        *time.Time     `gorm:"column:timestamp_value" json:"timestamp_value"`
 	Boolean          *bool          `gorm:"column:boolean_value" json:"boolean_value"`
+	Binary           []byte         `gorm:"column:binary_data;type:bytea" json:"binary_data"`
+	GeoPoint         *GeoPoint      `gorm:"column:geo_point;type:point" json:"geo_point"`
+	// Array marks the container of an array, its elements are the children labelled by their index
+	Array bool `gorm:"column:array_value;not null;default:false" json:"array_value"`
+	// Null marks an explicit JSON null, a row without any value being an empty object
+	Null bool `gorm:"column:null_value;not null;default:false" json:"null_value"`
+	// JSON holds the values without a dedicated column, such as mixed arrays or arrays of objects
+	JSON []byte `gorm:"column:json_value;type:jsonb" json:"json_value"`
 }
 
+// ErrOverlappingPaths is returned when a path of a multi-path update is an ancestor of, or equal to, another one
+var ErrOverlappingPaths = errors.New("overlapping update paths")
+
 func (*SafeRow) TableName() string {
 	return "realtime.safe_rows"
 }
 
+// safeRowValueColumns are the columns holding the value of a SafeRow, only one of them is set per row
+var safeRowValueColumns = []string{
+	"int_value", "bigint_value", "float_value", "numeric_value", "text_value", "uuid_value",
+	"collection_string", "collection_int", "timestamp_value", "boolean_value",
+	"binary_data", "geo_point", "null_value", "array_value", "json_value",
+}
+
 type LTree string
 
 func (l *LTree) Scan(value interface{}) error {
@@ -41,8 +66,12 @@ func (l LTree) Value() (driver.Value, error) {
 	return string(l), nil
 }
 
+// FormatChildrenRecursive rebuilds the object stored under the ltree path startPath from its rows,
+// the labels are decoded back into their keys and the array containers are rebuilt as JSON arrays
 func FormatChildrenRecursive(children []*SafeRow, startPath string) (map[string]interface{}, error) {
 	results := make(map[string]interface{})
+	// arrays holds the relative paths of the array containers
+	arrays := make(map[string]struct{})
 
 	for _, child := range children {
 		childPath := string(child.Path)
@@ -63,6 +92,10 @@ func FormatChildrenRecursive(children []*SafeRow, startPath string) (map[string]
 		if err != nil {
 			return nil, fmt.Errorf("error getting value for path %s: %w", child.Path, err)
 		}
+		if child.Array && relativePath != "" {
+			// the container holds no value, its elements are collected like the keys of a map
+			arrays[relativePath] = struct{}{}
+		}
 
 		// Navigate or create nested maps
 		current := results
@@ -70,7 +103,8 @@ func FormatChildrenRecursive(children []*SafeRow, startPath string) (map[string]
 			if part == "" {
 				continue
 			}
-			if i == len(pathParts)-1 {
+			part = DecodeLabel(part)
+			if i == len(pathParts)-1 && !child.Array {
 				// Last part, set the value
 				current[part] = value
 			} else {
@@ -89,9 +123,79 @@ func FormatChildrenRecursive(children []*SafeRow, startPath string) (map[string]
 		}
 	}
 
+	for key, value := range results {
+		results[key] = rebuildArrays(value, EncodeLabel(key), arrays)
+	}
 	return results, nil
 }
 
+// ReadSubtree reads the whole JSON value stored at the ltree path, found is false when nothing is stored under it
+func ReadSubtree(db *gorm.DB, path string) (interface{}, bool, error) {
+	return ReadTree(db, path, TreeReadOptions{})
+}
+
+// FormatSubtree rebuilds the JSON value stored at the ltree path startPath: the value of a single row,
+// an array when startPath is an array container, or an object
+func FormatSubtree(rows []*SafeRow, startPath string) (interface{}, error) {
+	root := startPath
+	var array bool
+	for _, row := range rows {
+		if string(row.Path) != root {
+			continue
+		}
+		if len(rows) == 1 && !row.Array {
+			return row.GetTheNonNullValue()
+		}
+		array = row.Array
+	}
+	children, err := FormatChildrenRecursive(rows, root)
+	if err != nil {
+		return nil, err
+	}
+	if array {
+		return arrayFromMap(children), nil
+	}
+	return children, nil
+}
+
+// rebuildArrays replaces the maps of the array containers by arrays, from the leaves up.
+// path is the relative ltree path of the value.
+func rebuildArrays(value interface{}, path string, arrays map[string]struct{}) interface{} {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	for key, child := range object {
+		object[key] = rebuildArrays(child, path+"."+EncodeLabel(key), arrays)
+	}
+	if _, ok := arrays[path]; ok {
+		return arrayFromMap(object)
+	}
+	return object
+}
+
+// arrayFromMap orders the elements of an array container by index, a missing index being null.
+// Like in Firebase, a container whose keys are not all indices, or whose largest index is at least
+// twice its number of elements, is returned as an object instead of a mostly empty array.
+func arrayFromMap(elements map[string]interface{}) interface{} {
+	length := 0
+	for key := range elements {
+		index, err := strconv.Atoi(key)
+		if err != nil || index < 0 || index >= 2*len(elements) {
+			return elements
+		}
+		if index >= length {
+			length = index + 1
+		}
+	}
+	array := make([]interface{}, length)
+	for key, element := range elements {
+		index, _ := strconv.Atoi(key)
+		array[index] = element
+	}
+	return array
+}
+
 func (s *SafeRow) ToJson() (string, error) {
 	dataInterface := map[string]interface{}{}
 	uniqueValue, err := s.GetTheNonNullValue()
@@ -112,98 +216,186 @@ func (s *SafeRow) GetKeyFromPath() string {
 	return splittedPath[len(splittedPath)-1]
 }
 
+// GetTheNonNullValue returns the JSON value held by the row, numbers beyond the float precision
+// are returned as json.Number so that they encode back exactly
 func (s *SafeRow) GetTheNonNullValue() (interface{}, error) {
-	if s.Int != nil {
+	switch {
+	case s.Int != nil:
 		return *s.Int, nil
-	} else if s.Text != nil {
+	case s.BigInt != nil:
+		return *s.BigInt, nil
+	case s.Float != nil:
+		return *s.Float, nil
+	case s.Numeric != nil:
+		return json.Number(*s.Numeric), nil
+	case s.Text != nil:
 		return *s.Text, nil
-	} else if len(s.CollectionString) > 0 {
-		return s.CollectionString, nil
-	} else if len(s.CollectionInt) > 0 {
-		return s.CollectionInt, nil
-	} else if s.Timestamp != nil {
+	case s.UUID != nil:
+		return *s.UUID, nil
+	case s.CollectionString != nil:
+		return []string(s.CollectionString), nil
+	case s.CollectionInt != nil:
+		return []int32(s.CollectionInt), nil
+	case s.Timestamp != nil:
 		return *s.Timestamp, nil
-	} else if s.Boolean != nil {
+	case s.Boolean != nil:
 		return *s.Boolean, nil
+	case s.Binary != nil:
+		return map[string]interface{}{BinaryValue: base64.StdEncoding.EncodeToString(s.Binary)}, nil
+	case s.GeoPoint != nil:
+		return map[string]interface{}{GeoPointValue: *s.GeoPoint}, nil
+	case s.JSON != nil:
+		var value interface{}
+		if err := decodeJSON(s.JSON, &value); err != nil {
+			return nil, err
+		}
+		return value, nil
 	}
 	return nil, nil
 }
 
 func InsertInSafeRow(db *gorm.DB, values *[]map[string]interface{}) error {
-	rows := make([]SafeRow, 0)
+	rows, transforms, err := splitSafeRows(values)
+	if err != nil {
+		return err
+	}
 
-	for _, value := range *values {
-		// we need to get the type of the value
-		var safeRow SafeRow = SafeRow{
-			Path: LTree(value["path"].(string)),
+	return db.Transaction(func(tx *gorm.DB) error {
+		// we need to remove bottom rows if they are already in the database
+		// we remove any path that start with each path
+		for _, row := range rows {
+			err := StartWith(string(row.Path), tx).Delete(&SafeRow{}).Error
+			if err != nil {
+				return err
+			}
+			if err := deleteValueAncestors(tx, string(row.Path)); err != nil {
+				return err
+			}
 		}
-		for key, val := range value {
-			if key == "path" {
-				continue
+		// a transformed row keeps its current value, only its children are replaced
+		for path := range transforms {
+			if err := Descendants(path, tx).Delete(&SafeRow{}).Error; err != nil {
+				return err
+			}
+			if err := deleteValueAncestors(tx, path); err != nil {
+				return err
 			}
-			switch val := val.(type) {
-			case int:
-				intValue := int32(val)
-				safeRow.Int = &intValue
-			case float64:
-				intValue := int32(val)
-				safeRow.Int = &intValue
-			case string:
-				textValue := val
-				safeRow.Text = &textValue
-			case time.Time:
-				timestampValue := val
-				safeRow.Timestamp = &timestampValue
-			case bool:
-				booleanValue := val
-				safeRow.Boolean = &booleanValue
+		}
+		if err := upsertSafeRows(tx, rows); err != nil {
+			return err
+		}
+		return applySafeRowTransforms(tx, transforms)
+	})
+}
+
+// UpdateSafeRowPaths replaces the subtree of each root path in a single transaction:
+// the subtrees are removed, then the rows generated for the new values are inserted.
+// A root without generated rows is simply deleted. Roots nested in one another return ErrOverlappingPaths.
+func UpdateSafeRowPaths(db *gorm.DB, roots []string, values *[]map[string]interface{}) error {
+	for i, root := range roots {
+		for _, other := range roots[i+1:] {
+			if root == "" || other == "" || root == other ||
+				strings.HasPrefix(root, other+".") || strings.HasPrefix(other, root+".") {
+				return fmt.Errorf("%w: %q and %q", ErrOverlappingPaths, LTreeToTreePath(root), LTreeToTreePath(other))
 			}
+		}
+	}
+	rows, transforms, err := splitSafeRows(values)
+	if err != nil {
+		return err
+	}
 
-			// it's possible that the value is an array of values and we need to check the type of the first element
-			// to know the type of the array
-			switch val := val.(type) {
-			case []interface{}:
-				if len(val) == 0 {
-					continue
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, root := range roots {
+			if root == "" {
+				if err := tx.Where("1 = 1").Delete(&SafeRow{}).Error; err != nil {
+					return err
 				}
-				switch val[0].(type) {
-				case string:
-					collectionString := make([]string, 0)
-					for _, v := range val {
-						collectionString = append(collectionString, v.(string))
-					}
-					safeRow.CollectionString = collectionString
-				case int:
-					collectionInt := make([]int32, 0)
-					for _, v := range val {
-						collectionInt = append(collectionInt, int32(v.(int)))
-					}
-					safeRow.CollectionInt = collectionInt
-				case float64:
-					collectionInt := make([]int32, 0)
-					for _, v := range val {
-						collectionInt = append(collectionInt, int32(v.(float64)))
-					}
-					safeRow.CollectionInt = collectionInt
+				continue
+			}
+			subtree := StartWith(root, tx)
+			if _, ok := transforms[root]; ok {
+				// a transformed root keeps its current value
+				subtree = Descendants(root, tx)
+			}
+			if err := subtree.Delete(&SafeRow{}).Error; err != nil {
+				return err
+			}
+			if err := deleteValueAncestors(tx, root); err != nil {
+				return err
+			}
+		}
+		if err := upsertSafeRows(tx, rows); err != nil {
+			return err
+		}
+		return applySafeRowTransforms(tx, transforms)
+	})
+}
+
+// deleteValueAncestors removes the values stored on the ancestors of the path, they would hide
+// its new children. An array container holds them and is kept.
+func deleteValueAncestors(tx *gorm.DB, path string) error {
+	return tx.Where("path @> ? AND path <> ? AND NOT array_value", path, path).Delete(&SafeRow{}).Error
+}
+
+// splitSafeRows converts the generated paths into SafeRows, except for the transform
+// sentinels which are returned by path
+func splitSafeRows(values *[]map[string]interface{}) ([]SafeRow, map[string]FieldTransform, error) {
+	rows := make([]SafeRow, 0)
+	transforms := make(map[string]FieldTransform)
+	for _, value := range *values {
+		path := value["path"].(string)
+		if sentinel := value["value"]; IsTransform(sentinel) {
+			transform, err := newFieldTransform(strings.Split(path, "."), sentinel.(map[string]interface{}))
+			if err != nil {
+				return nil, nil, err
+			}
+			// the SafeRow arrays are typed, unlike the jsonb arrays of the documents
+			if transform.Kind == ArrayUnionTransform || transform.Kind == ArrayRemoveTransform {
+				if _, _, _, err := safeRowArray(transform, ""); err != nil {
+					return nil, nil, err
 				}
 			}
+			transforms[path] = transform
+			continue
 		}
-		rows = append(rows, safeRow)
+		row, err := newSafeRow(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		rows = append(rows, row)
 	}
+	return rows, transforms, nil
+}
 
-	// we need to remove bottom rows if they are already in the database
-	// we remove any path that start with each path
-	for _, row := range rows {
-		err := StartWith(string(row.Path), db).Delete(&SafeRow{}).Error
-		if err != nil {
+func applySafeRowTransforms(db *gorm.DB, transforms map[string]FieldTransform) error {
+	for path, transform := range transforms {
+		if err := applySafeRowTransform(db, path, transform); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+func upsertSafeRows(db *gorm.DB, rows []SafeRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
 	return db.Clauses(clause.OnConflict{
 		Columns:   []clause.Column{{Name: "path"}},
-		DoUpdates: clause.AssignmentColumns([]string{"int_value", "text_value", "collection_string", "collection_int", "timestamp_value", "boolean_value", "numeric_value", "uuid_value", "binary_data", "geo_point"}),
+		DoUpdates: clause.AssignmentColumns(safeRowValueColumns),
 	}).Create(&rows).Error
+}
 
+// newSafeRow converts a generated {"path": ..., "value": ...} entry into a SafeRow
+func newSafeRow(value map[string]interface{}) (SafeRow, error) {
+	safeRow := SafeRow{
+		Path: LTree(value["path"].(string)),
+	}
+	if err := setSafeRowValue(&safeRow, value["value"]); err != nil {
+		return safeRow, fmt.Errorf("invalid value at %s: %w", safeRow.Path, err)
+	}
+	return safeRow, nil
 }
 
 func DeleteInSafeRow(db *gorm.DB, path *string) error {
@@ -1,15 +1,30 @@
 package database
 
 import (
+	"strings"
+
 	"gorm.io/gorm"
 )
 
+// PathToLTree converts a client collection path (`rooms/42` or `rooms.42`) into its ltree notation,
+// paths of the SafeRow tree go through TreePathToLTree which escapes their keys
+func PathToLTree(path string) string {
+	return strings.Trim(strings.ReplaceAll(path, "/", "."), ".")
+}
+
 func StartAndEndWith(start, end string, g *gorm.DB) *gorm.DB {
 	return g.Where("path ~ ?", start+".*."+end)
 }
 
+// StartWith matches the ltree path start and the paths under it. The path is compared as an ltree
+// value rather than an lquery pattern, so that its escaped labels are never read as pattern syntax.
 func StartWith(start string, g *gorm.DB) *gorm.DB {
-	return g.Where("path ~ ?", start+".*")
+	return g.Where("path <@ ?::ltree", start)
+}
+
+// Descendants matches the paths under start, excluding start itself
+func Descendants(start string, g *gorm.DB) *gorm.DB {
+	return g.Where("path <@ ?::ltree AND path <> ?::ltree", start, start)
 }
 
 func EndWith(end string, g *gorm.DB) *gorm.DB {
@@ -21,7 +36,7 @@ func Contains(contains string, g *gorm.DB) *gorm.DB {
 }
 
 func Equals(equals string, g *gorm.DB) *gorm.DB {
-	return g.Where("path = ?", equals)
+	return g.Where("path = ?::ltree", equals)
 }
 
 func NotEquals(notEquals string, g *gorm.DB) *gorm.DB {
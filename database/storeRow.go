@@ -1,17 +1,37 @@
 package database
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 
+	"github.com/lib/pq"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type StoreRow struct {
 	Collection   LTree  `gorm:"column:path;type:ltree;index:idx_full_path,unique" json:"collection"`
 	CollectionId string `gorm:"index:idx_full_path,unique" json:"collection_id"`
 	Data         []byte `gorm:"column:data;type:jsonb" json:"data"`
+	// Version is incremented by every write, it is exposed as the document ETag
+	Version int64 `gorm:"column:version;not null;default:1" json:"version"`
+}
+
+// ErrVersionMismatch is returned when a write expected another version of the document
+var ErrVersionMismatch = errors.New("document version mismatch")
+
+// AnyVersion passed as ifVersion only requires the document to exist, like `If-Match: *`
+const AnyVersion int64 = -1
+
+// WriteResult reports whether a write created the document, the version it produced and
+// the written data once its field transforms are resolved
+type WriteResult struct {
+	Created bool                   `json:"created"`
+	Version int64                  `json:"version"`
+	Data    map[string]interface{} `json:"-"`
 }
 
 func (*StoreRow) TableName() string {
@@ -27,19 +47,7 @@ func GetCollection(db *gorm.DB, collection string) (map[string]interface{}, erro
 		return nil, err
 	}
 
-	data := make(map[string]interface{}, 0)
-	for _, row := range rows {
-		// data is in base64, decode it
-		var decodedData map[string]interface{}
-		err = json.Unmarshal(row.Data, &decodedData)
-		if err != nil {
-			return nil, err
-		}
-
-		data[row.CollectionId] = decodedData
-	}
-
-	return data, nil
+	return DecodeRows(rows)
 }
 
 func MergeInterface(a, b map[string]interface{}) map[string]interface{} {
@@ -65,7 +73,10 @@ func UpdateInterface(db *gorm.DB, collection string, id string, data map[string]
 	}
 
 	// update the row
-	err = db.Model(&StoreRow{}).Where("path = ?", collection).Where("collection_id = ?", id).Update("data", jsonData).Error
+	err = db.Model(&StoreRow{}).Where("path = ?", collection).Where("collection_id = ?", id).Updates(map[string]interface{}{
+		"data":    jsonData,
+		"version": gorm.Expr("version + 1"),
+	}).Error
 	return err
 }
 
@@ -85,28 +96,120 @@ func CreateInterface(db *gorm.DB, collection string, id string, data map[string]
 	return err
 }
 
-func DeleteInterface(db *gorm.DB, collection string, id string) error {
+// DeleteInterface deletes a document, returning gorm.ErrRecordNotFound when it does not exist.
+// When ifVersion is not 0 the document is only deleted at that version (or at any version for AnyVersion),
+// otherwise ErrVersionMismatch is returned.
+func DeleteInterface(db *gorm.DB, collection string, id string, ifVersion int64) error {
 	// delete the row
-	err := db.Where("path = ?", collection).Where("collection_id = ?", id).Delete(&StoreRow{}).Error
-	return err
+	query := db.Where("path = ?", collection).Where("collection_id = ?", id)
+	if ifVersion > 0 {
+		query = query.Where("version = ?", ifVersion)
+	}
+	result := query.Delete(&StoreRow{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if ifVersion != 0 {
+			return ErrVersionMismatch
+		}
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeleteCollection deletes every document of a collection and returns how many were removed
+func DeleteCollection(db *gorm.DB, collection string) (int64, error) {
+	result := db.Where("path = ?", collection).Delete(&StoreRow{})
+	return result.RowsAffected, result.Error
+}
+
+// PatchInterface deep merges the patch into an existing document following RFC 7396,
+// a null value deletes the key. It returns the merged document and its new version.
+// When ifVersion is not 0 the document is only patched at that version (or at any version for AnyVersion),
+// otherwise ErrVersionMismatch is returned.
+func PatchInterface(db *gorm.DB, collection string, id string, patch map[string]interface{}, ifVersion int64) (map[string]interface{}, int64, error) {
+	var merged map[string]interface{}
+	var version int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var row StoreRow
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("path = ?", collection).Where("collection_id = ?", id).First(&row).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) && ifVersion != 0 {
+			return ErrVersionMismatch
+		}
+		if err != nil {
+			return err
+		}
+		if ifVersion > 0 && row.Version != ifVersion {
+			return ErrVersionMismatch
+		}
+
+		current := make(map[string]interface{})
+		if err := decodeJSON(row.Data, &current); err != nil {
+			return err
+		}
+		clean, transforms, err := ExtractTransforms(patch)
+		if err != nil {
+			return err
+		}
+		merged = MergePatchInterface(current, clean)
+		version = row.Version + 1
+		if err := UpdateInterface(tx, collection, id, merged); err != nil {
+			return err
+		}
+		if len(transforms) > 0 {
+			merged, err = applyDocumentTransforms(tx, collection, id, transforms)
+		}
+		return err
+	})
+	return merged, version, err
+}
+
+// MergePatchInterface merges b into a like MergeInterface, except that null values delete the key (RFC 7396)
+func MergePatchInterface(a, b map[string]interface{}) map[string]interface{} {
+	if a == nil {
+		a = make(map[string]interface{})
+	}
+	for k, v := range b {
+		if v == nil {
+			delete(a, k)
+			continue
+		}
+		if patch, ok := v.(map[string]interface{}); ok {
+			current, ok := a[k].(map[string]interface{})
+			if !ok {
+				current = make(map[string]interface{})
+			}
+			a[k] = MergePatchInterface(current, patch)
+		} else {
+			a[k] = v
+		}
+	}
+	return a
 }
 
 func GetInterface(db *gorm.DB, collection string, id string) (map[string]interface{}, error) {
+	data, _, err := GetInterfaceWithVersion(db, collection, id)
+	return data, err
+}
+
+// GetInterfaceWithVersion returns the data of a document and its current version
+func GetInterfaceWithVersion(db *gorm.DB, collection string, id string) (map[string]interface{}, int64, error) {
 	// get the row
 	var row StoreRow
 	err := db.Where("path = ?", collection).Where("collection_id = ?", id).First(&row).Error
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// decode JSON data
 	var data map[string]interface{}
-	err = json.Unmarshal(row.Data, &data)
+	err = decodeJSON(row.Data, &data)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	return data, nil
+	return data, row.Version, nil
 }
 
 func GetChildCollections(db *gorm.DB, collection string) ([]string, error) {
@@ -126,49 +229,159 @@ func GetChildCollections(db *gorm.DB, collection string) ([]string, error) {
 	return collections, nil
 }
 
-func UpdateOrCreateInterface(db *gorm.DB, collection string, id string, data map[string]interface{}) error {
-	// Update the row if it exists
-
-	jsonData, err := json.Marshal(data)
-
+// UpdateOrCreateInterface creates the document or replaces its data when it already exists.
+// When ifVersion is not 0 the document must exist at that version (or at any version for AnyVersion),
+// otherwise ErrVersionMismatch is returned.
+func UpdateOrCreateInterface(db *gorm.DB, collection string, id string, data map[string]interface{}, ifVersion int64) (WriteResult, error) {
+	var result WriteResult
+	clean, transforms, err := ExtractTransforms(data)
 	if err != nil {
-		return err
+		return result, err
+	}
+	jsonData, err := json.Marshal(clean)
+	if err != nil {
+		return result, err
 	}
 
-	return db.Model(&StoreRow{}).Where("path = ?", collection).Where("collection_id = ?", id).FirstOrCreate(&StoreRow{
-		Collection:   LTree(collection),
-		CollectionId: id,
-		Data:         jsonData,
-	}).Error
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if ifVersion != 0 {
+			update := `UPDATE store.store_rows SET data = ?, version = version + 1 WHERE path = ? AND collection_id = ?`
+			args := []interface{}{jsonData, LTree(collection), id}
+			if ifVersion > 0 {
+				update += " AND version = ?"
+				args = append(args, ifVersion)
+			}
+			query := tx.Raw(update+" RETURNING version", args...).Scan(&result.Version)
+			if query.Error != nil {
+				return query.Error
+			}
+			if query.RowsAffected == 0 {
+				return ErrVersionMismatch
+			}
+		} else {
+			// xmax is only set on rows rewritten by the ON CONFLICT branch
+			err := tx.Raw(
+				`INSERT INTO store.store_rows (path, collection_id, data) VALUES (?, ?, ?)
+				ON CONFLICT (path, collection_id) DO UPDATE SET data = EXCLUDED.data, version = store_rows.version + 1
+				RETURNING (xmax = 0) AS created, version`,
+				LTree(collection), id, jsonData,
+			).Scan(&result).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		result.Data = clean
+		if len(transforms) > 0 {
+			result.Data, err = applyDocumentTransforms(tx, collection, id, transforms)
+		}
+		return err
+	})
+	return result, err
 }
 
 type FilterSearch struct {
+	// Path is the dotted JSON field compared by the filter, the whole document when empty
 	Path       string `json:"path"`
 	SearchType string `json:"searchType"`
 	Value      string `json:"value"`
+	// EndValue is the suffix of a startAndEndWith filter
+	EndValue string `json:"endValue"`
 }
 
-func SearchUsingJsonBPath(db *gorm.DB, collection string, filters []FilterSearch) ([]StoreRow, error) {
+// Query is a set of filters combined with the "and" (default) or "or" operator
+type Query struct {
+	Filters  []FilterSearch `json:"filters"`
+	Operator string         `json:"operator"`
+}
+
+func SearchUsingJsonBPath(db *gorm.DB, collection string, query Query) ([]StoreRow, error) {
 	var rows []StoreRow
-	var err error
-	var finalQuery *gorm.DB = db.Where("path = ?", collection)
-	for _, filter := range filters {
+	finalQuery, err := ApplyFilters(db.Where("path = ?", collection), query)
+	if err != nil {
+		return nil, err
+	}
+	err = finalQuery.Find(&rows).Error
+	return rows, err
+}
+
+// ApplyFilters adds the filters of the query to the gorm query as one grouped condition.
+// Every user supplied value is sent as a bound parameter.
+func ApplyFilters(db *gorm.DB, query Query) (*gorm.DB, error) {
+	if len(query.Filters) == 0 {
+		return db, nil
+	}
+
+	var separator string
+	switch strings.ToLower(query.Operator) {
+	case "", "and":
+		separator = " AND "
+	case "or":
+		separator = " OR "
+	default:
+		return nil, fmt.Errorf("unknown operator %q", query.Operator)
+	}
+
+	conditions := make([]string, 0, len(query.Filters))
+	args := make([]interface{}, 0, len(query.Filters)*2)
+	for _, filter := range query.Filters {
+		field := pq.StringArray(jsonFieldPath(filter.Path))
 		switch filter.SearchType {
 		case "contains":
-			finalQuery = db.Where("jsonb_path_exists(data, $1)", fmt.Sprintf("$[*] ? (@ like_regex \"%s\")", strings.ReplaceAll(filter.Value, "*", ".*")))
+			// * stays a wildcard inside contains filters
+			conditions = append(conditions, "data #>> ?::text[] LIKE ?")
+			args = append(args, field, "%"+strings.ReplaceAll(escapeLike(filter.Value), "*", "%")+"%")
 		case "equals":
-			finalQuery = db.Where("jsonb_path_exists(data, $1)", fmt.Sprintf("$[*] ? (@ == \"%s\")", filter.Value))
+			conditions = append(conditions, "data #>> ?::text[] = ?")
+			args = append(args, field, filter.Value)
 		case "notEquals":
-			finalQuery = db.Not("jsonb_path_exists(data, $1)", fmt.Sprintf("$[*] ? (@ == \"%s\")", filter.Value))
+			conditions = append(conditions, "data #>> ?::text[] IS DISTINCT FROM ?")
+			args = append(args, field, filter.Value)
 		case "startWith":
-			finalQuery = db.Where("jsonb_path_exists(data, $1)", fmt.Sprintf("$[*] ? (@ like_regex \"%s.*\")", filter.Value))
+			conditions = append(conditions, "data #>> ?::text[] LIKE ?")
+			args = append(args, field, escapeLike(filter.Value)+"%")
 		case "endWith":
-			finalQuery = db.Where("jsonb_path_exists(data, $1)", fmt.Sprintf("$[*] ? (@ like_regex \".*%s\")", filter.Value))
+			conditions = append(conditions, "data #>> ?::text[] LIKE ?")
+			args = append(args, field, "%"+escapeLike(filter.Value))
 		case "startAndEndWith":
-			finalQuery = db.Where("jsonb_path_exists(data, $1)", fmt.Sprintf("$[*] ? (@ like_regex \"%s.*%s\")", filter.Path, filter.Value))
+			conditions = append(conditions, "data #>> ?::text[] LIKE ?")
+			args = append(args, field, escapeLike(filter.Value)+"%"+escapeLike(filter.EndValue))
+		default:
+			return nil, fmt.Errorf("unknown search type %q", filter.SearchType)
 		}
 	}
 
-	err = finalQuery.Find(&rows).Error
-	return rows, err
+	return db.Where("("+strings.Join(conditions, separator)+")", args...), nil
+}
+
+// jsonFieldPath converts a dotted JSON field into the text[] path used by the #> operators
+func jsonFieldPath(field string) []string {
+	if field == "" {
+		return []string{}
+	}
+	return strings.Split(field, ".")
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+// DecodeRows returns the data of each row keyed by its collection id
+func DecodeRows(rows []StoreRow) (map[string]interface{}, error) {
+	data := make(map[string]interface{}, len(rows))
+	for _, row := range rows {
+		var decodedData map[string]interface{}
+		if err := decodeJSON(row.Data, &decodedData); err != nil {
+			return nil, err
+		}
+		data[row.CollectionId] = decodedData
+	}
+	return data, nil
+}
+
+// decodeJSON decodes numbers as json.Number so that integers beyond 2^53 and decimals are kept exactly
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
 }
@@ -0,0 +1,150 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// serializationFailure is the SQLSTATE of a serializable transaction conflicting with a concurrent one
+const serializationFailure = "40001"
+
+const (
+	TransactionSet    = "set"
+	TransactionMerge  = "merge"
+	TransactionDelete = "delete"
+)
+
+// DocumentRef identifies a document of the store
+type DocumentRef struct {
+	Collection string `json:"collection"`
+	ID         string `json:"id"`
+}
+
+// VersionedDocument is a document read at a given version, Version is 0 when it does not exist
+type VersionedDocument struct {
+	DocumentRef
+	Version int64                  `json:"version"`
+	Data    map[string]interface{} `json:"data"`
+}
+
+// TransactionRead is a precondition of a transaction: the document must still be at Version (0 meaning absent)
+type TransactionRead struct {
+	DocumentRef
+	Version int64 `json:"version"`
+}
+
+// TransactionWrite is a set (replace), merge (RFC 7396 patch) or delete of a document
+type TransactionWrite struct {
+	DocumentRef
+	Op   string                 `json:"op"`
+	Data map[string]interface{} `json:"data"`
+}
+
+type Transaction struct {
+	Reads  []TransactionRead  `json:"reads"`
+	Writes []TransactionWrite `json:"writes"`
+}
+
+// TransactionResult describes the outcome of one write of a committed transaction
+type TransactionResult struct {
+	DocumentRef
+	Op      string                 `json:"op"`
+	Created bool                   `json:"created"`
+	Version int64                  `json:"version"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// ReadDocuments returns the current data and version of each document, absent documents have version 0
+func ReadDocuments(db *gorm.DB, refs []DocumentRef) ([]VersionedDocument, error) {
+	documents := make([]VersionedDocument, 0, len(refs))
+	for _, ref := range refs {
+		data, version, err := GetInterfaceWithVersion(db, ref.Collection, ref.ID)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		documents = append(documents, VersionedDocument{DocumentRef: ref, Version: version, Data: data})
+	}
+	return documents, nil
+}
+
+// CommitTransaction applies the writes only if every read document is still at the version it was read at.
+// It returns ErrVersionMismatch, and writes nothing, when one of them changed in the meantime.
+// It runs serializable: a document read as absent has no row to lock, and a concurrent
+// transaction creating it fails with a serialization failure instead of being overwritten.
+func CommitTransaction(db *gorm.DB, transaction Transaction) ([]TransactionResult, error) {
+	for _, write := range transaction.Writes {
+		switch write.Op {
+		case TransactionSet, TransactionMerge, TransactionDelete:
+		default:
+			return nil, fmt.Errorf("unknown write op %q", write.Op)
+		}
+	}
+
+	// lock the read documents in a stable order so that concurrent transactions cannot deadlock
+	reads := append([]TransactionRead{}, transaction.Reads...)
+	sort.Slice(reads, func(i, j int) bool {
+		if reads[i].Collection != reads[j].Collection {
+			return reads[i].Collection < reads[j].Collection
+		}
+		return reads[i].ID < reads[j].ID
+	})
+
+	results := make([]TransactionResult, 0, len(transaction.Writes))
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, read := range reads {
+			var rows []StoreRow
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("path = ?", read.Collection).Where("collection_id = ?", read.ID).
+				Find(&rows).Error
+			if err != nil {
+				return err
+			}
+			var version int64
+			if len(rows) > 0 {
+				version = rows[0].Version
+			}
+			if version != read.Version {
+				return ErrVersionMismatch
+			}
+		}
+
+		for _, write := range transaction.Writes {
+			result := TransactionResult{DocumentRef: write.DocumentRef, Op: write.Op}
+			switch write.Op {
+			case TransactionSet:
+				written, err := UpdateOrCreateInterface(tx, write.Collection, write.ID, write.Data, 0)
+				if err != nil {
+					return err
+				}
+				result.Created, result.Version, result.Data = written.Created, written.Version, written.Data
+			case TransactionMerge:
+				data, version, err := PatchInterface(tx, write.Collection, write.ID, write.Data, 0)
+				if err != nil {
+					return err
+				}
+				result.Version, result.Data = version, data
+			case TransactionDelete:
+				err := DeleteInterface(tx, write.Collection, write.ID, 0)
+				if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+					return err
+				}
+			}
+			results = append(results, result)
+		}
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == serializationFailure {
+		return nil, fmt.Errorf("%w: %s", ErrVersionMismatch, pgErr.Message)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,316 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// Sentinel keys of the field transforms accepted in write payloads, e.g. {"views": {"$increment": 1}}
+const (
+	IncrementTransform       = "$increment"
+	ArrayUnionTransform      = "$arrayUnion"
+	ArrayRemoveTransform     = "$arrayRemove"
+	ServerTimestampTransform = "$serverTimestamp"
+)
+
+var ErrInvalidTransform = errors.New("invalid transform")
+
+// FieldTransform is a sentinel value extracted from a write, resolved by Postgres when the write is applied
+type FieldTransform struct {
+	// Field is the path of the transformed field from the root of the document
+	Field []string
+	Kind  string
+	Value interface{}
+}
+
+// IsTransform reports whether the value is a transform sentinel
+func IsTransform(value interface{}) bool {
+	object, ok := value.(map[string]interface{})
+	if !ok || len(object) != 1 {
+		return false
+	}
+	for key := range object {
+		switch key {
+		case IncrementTransform, ArrayUnionTransform, ArrayRemoveTransform, ServerTimestampTransform:
+			return true
+		}
+	}
+	return false
+}
+
+// newFieldTransform validates a sentinel value found at the given field
+func newFieldTransform(field []string, sentinel map[string]interface{}) (FieldTransform, error) {
+	for kind, value := range sentinel {
+		transform := FieldTransform{Field: field, Kind: kind, Value: value}
+		switch kind {
+		case IncrementTransform:
+			if !isJSONNumber(value) {
+				return transform, fmt.Errorf("%w: %s of %s expects a number", ErrInvalidTransform, kind, strings.Join(field, "."))
+			}
+		case ArrayUnionTransform, ArrayRemoveTransform:
+			if _, ok := value.([]interface{}); !ok {
+				return transform, fmt.Errorf("%w: %s of %s expects an array", ErrInvalidTransform, kind, strings.Join(field, "."))
+			}
+		case ServerTimestampTransform:
+			if value != true {
+				return transform, fmt.Errorf("%w: %s of %s expects true", ErrInvalidTransform, kind, strings.Join(field, "."))
+			}
+		}
+		return transform, nil
+	}
+	return FieldTransform{}, ErrInvalidTransform
+}
+
+// ExtractTransforms returns a copy of the data without its transform sentinels, and the transforms themselves.
+// The objects containing a sentinel are kept, even when empty, so that the transformed fields have a parent.
+func ExtractTransforms(data map[string]interface{}) (map[string]interface{}, []FieldTransform, error) {
+	transforms := make([]FieldTransform, 0)
+	clean, err := extractTransforms(data, nil, &transforms)
+	return clean, transforms, err
+}
+
+func extractTransforms(data map[string]interface{}, parent []string, transforms *[]FieldTransform) (map[string]interface{}, error) {
+	clean := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		field := append(append([]string{}, parent...), key)
+		if IsTransform(value) {
+			transform, err := newFieldTransform(field, value.(map[string]interface{}))
+			if err != nil {
+				return nil, err
+			}
+			*transforms = append(*transforms, transform)
+			continue
+		}
+		if object, ok := value.(map[string]interface{}); ok {
+			nested, err := extractTransforms(object, field, transforms)
+			if err != nil {
+				return nil, err
+			}
+			clean[key] = nested
+			continue
+		}
+		clean[key] = value
+	}
+	return clean, nil
+}
+
+// applyDocumentTransforms resolves the transforms on the stored document in a single UPDATE
+// and returns the resulting data. It does not change the document version.
+func applyDocumentTransforms(db *gorm.DB, collection string, id string, transforms []FieldTransform) (map[string]interface{}, error) {
+	expression := "data"
+	args := make([]interface{}, 0)
+	for _, transform := range transforms {
+		field := pq.StringArray(transform.Field)
+		value, valueArgs, err := documentTransformExpression(transform)
+		if err != nil {
+			return nil, err
+		}
+		expression = "jsonb_set(" + expression + ", ?::text[], " + value + ", true)"
+		args = append(args, field)
+		args = append(args, valueArgs...)
+	}
+
+	var encoded []byte
+	query := db.Raw(
+		"UPDATE store.store_rows SET data = "+expression+" WHERE path = ? AND collection_id = ? RETURNING data",
+		append(args, LTree(collection), id)...,
+	).Scan(&encoded)
+	if query.Error != nil {
+		return nil, query.Error
+	}
+	if query.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var data map[string]interface{}
+	if err := decodeJSON(encoded, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// documentTransformExpression returns the SQL computing the new value of the field from the current `data`
+func documentTransformExpression(transform FieldTransform) (string, []interface{}, error) {
+	field := pq.StringArray(transform.Field)
+	switch transform.Kind {
+	case IncrementTransform:
+		return `to_jsonb(COALESCE(CASE WHEN jsonb_typeof(data #> ?::text[]) = 'number' THEN (data #>> ?::text[])::numeric END, 0) + ?::numeric)`,
+			[]interface{}{field, field, transform.Value}, nil
+	case ServerTimestampTransform:
+		return "to_jsonb(now())", nil, nil
+	}
+
+	values, err := json.Marshal(transform.Value)
+	if err != nil {
+		return "", nil, err
+	}
+	current := `COALESCE(CASE WHEN jsonb_typeof(data #> ?::text[]) = 'array' THEN data #> ?::text[] END, '[]'::jsonb)`
+	switch transform.Kind {
+	case ArrayUnionTransform:
+		return current + ` || COALESCE((SELECT jsonb_agg(e ORDER BY i) FROM jsonb_array_elements(?::jsonb) WITH ORDINALITY AS t(e, i)
+			WHERE NOT EXISTS (SELECT 1 FROM jsonb_array_elements(` + current + `) x WHERE x = e)), '[]'::jsonb)`,
+			[]interface{}{field, field, string(values), field, field}, nil
+	case ArrayRemoveTransform:
+		return `(SELECT COALESCE(jsonb_agg(x ORDER BY i), '[]'::jsonb) FROM jsonb_array_elements(` + current + `) WITH ORDINALITY AS t(x, i)
+			WHERE NOT EXISTS (SELECT 1 FROM jsonb_array_elements(?::jsonb) e WHERE e = x))`,
+			[]interface{}{field, field, string(values)}, nil
+	}
+	return "", nil, fmt.Errorf("unknown transform %s", transform.Kind)
+}
+
+// applySafeRowTransform resolves a transform on the SafeRow stored at path, creating the row when needed.
+// The other value columns of the row are cleared so that it only holds the transformed value.
+func applySafeRowTransform(db *gorm.DB, path string, transform FieldTransform) error {
+	var columns []string
+	var insertValue, assignment string
+	var insertArgs, updateArgs []interface{}
+
+	switch transform.Kind {
+	case IncrementTransform:
+		// the sum of any stored number is exact, integers are kept in bigint_value and fractions in numeric_value
+		delta, ok := numericString(transform.Value)
+		if !ok {
+			return fmt.Errorf("%w: %s of %s expects a number", ErrInvalidTransform, transform.Kind, strings.Join(transform.Field, "."))
+		}
+		columns = []string{"bigint_value", "numeric_value"}
+		insertValue = "?::bigint, ?::numeric"
+		if integer, ok := asInt64(transform.Value); ok {
+			insertArgs = []interface{}{integer, nil}
+		} else {
+			insertArgs = []interface{}{nil, delta}
+		}
+		assignment = "(bigint_value, numeric_value) = (SELECT CASE WHEN " + integralBigint("s") + " THEN s::bigint END, " +
+			"CASE WHEN " + integralBigint("s") + " THEN NULL ELSE s END " +
+			"FROM (SELECT COALESCE(safe_rows.numeric_value, safe_rows.float_value::numeric, safe_rows.bigint_value::numeric, " +
+			"safe_rows.int_value::numeric, 0) + ?::numeric AS s) AS sum)"
+		updateArgs = []interface{}{delta}
+	case ServerTimestampTransform:
+		columns = []string{"timestamp_value"}
+		insertValue, assignment = "now()", "timestamp_value = now()"
+	case ArrayUnionTransform, ArrayRemoveTransform:
+		stored, err := storedArrayColumn(db, path)
+		if err != nil {
+			return err
+		}
+		column, values, arrayType, err := safeRowArray(transform, stored)
+		if err != nil {
+			return err
+		}
+		columns = []string{column}
+		current := "COALESCE(safe_rows." + column + ", '{}'::" + arrayType + ")"
+		if transform.Kind == ArrayUnionTransform {
+			insertValue, insertArgs = "?::"+arrayType, []interface{}{values}
+			assignment = column + " = " + current + " || ARRAY(SELECT e FROM unnest(?::" + arrayType + ") WITH ORDINALITY AS t(e, i) WHERE NOT (e = ANY(" + current + ")) ORDER BY i)"
+		} else {
+			insertValue = "'{}'::" + arrayType
+			assignment = column + " = ARRAY(SELECT e FROM unnest(" + current + ") WITH ORDINALITY AS t(e, i) WHERE NOT (e = ANY(?::" + arrayType + ")) ORDER BY i)"
+		}
+		updateArgs = []interface{}{values}
+	default:
+		return fmt.Errorf("unknown transform %s", transform.Kind)
+	}
+
+	assignments := []string{assignment}
+	for _, other := range safeRowValueColumns {
+		switch {
+		case containsString(columns, other):
+		case other == "null_value" || other == "array_value":
+			assignments = append(assignments, other+" = false")
+		default:
+			assignments = append(assignments, other+" = NULL")
+		}
+	}
+	args := append(append([]interface{}{LTree(path)}, insertArgs...), updateArgs...)
+	return db.Exec(
+		"INSERT INTO realtime.safe_rows (path, "+strings.Join(columns, ", ")+") VALUES (?, "+insertValue+") "+
+			"ON CONFLICT (path) DO UPDATE SET "+strings.Join(assignments, ", "),
+		args...,
+	).Error
+}
+
+// integralBigint returns the SQL condition under which the numeric expression fits in a bigint
+func integralBigint(expression string) string {
+	return expression + " = trunc(" + expression + ") AND " + expression + " BETWEEN -9223372036854775808 AND 9223372036854775807"
+}
+
+// numericString returns the JSON number as the text of a Postgres numeric
+func numericString(value interface{}) (string, bool) {
+	if number, ok := value.(json.Number); ok {
+		return number.String(), true
+	}
+	if f, ok := asFloat64(value); ok {
+		return strconv.FormatFloat(f, 'g', -1, 64), true
+	}
+	return "", false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// safeRowArray picks the array column matching the values: text[] when they are strings, integer[] when they
+// are 32-bit integers. Other values, or values of the other type than the stored array, return ErrInvalidTransform.
+// An empty array applies to the stored column, if any.
+func safeRowArray(transform FieldTransform, stored string) (string, interface{}, string, error) {
+	values := transform.Value.([]interface{})
+	field := strings.Join(transform.Field, ".")
+	column, arrayType := stored, "text[]"
+	var array interface{}
+	if strs, ok := stringArray(values); ok && len(values) > 0 {
+		column, array = "collection_string", pq.StringArray(strs)
+	} else if ints, ok := int32Array(values); ok && len(values) > 0 {
+		column, array = "collection_int", pq.Int32Array(ints)
+	} else if len(values) > 0 {
+		return "", nil, "", fmt.Errorf("%w: %s of %s expects strings or 32-bit integers", ErrInvalidTransform, transform.Kind, field)
+	}
+	if stored != "" && column != stored {
+		return "", nil, "", fmt.Errorf("%w: %s of %s does not match the type of the stored array", ErrInvalidTransform, transform.Kind, field)
+	}
+	if column == "" {
+		column = "collection_string"
+	}
+	if column == "collection_int" {
+		arrayType = "integer[]"
+	}
+	if array == nil {
+		array = pq.StringArray{}
+		if column == "collection_int" {
+			array = pq.Int32Array{}
+		}
+	}
+	return column, array, arrayType, nil
+}
+
+// storedArrayColumn returns the array column set on the SafeRow stored at path, empty when it holds no array.
+// The row is locked until the end of the transaction.
+func storedArrayColumn(db *gorm.DB, path string) (string, error) {
+	var stored []struct {
+		Strings bool
+		Ints    bool
+	}
+	err := db.Raw(
+		"SELECT collection_string IS NOT NULL AS strings, collection_int IS NOT NULL AS ints FROM realtime.safe_rows WHERE path = ? FOR UPDATE",
+		LTree(path),
+	).Scan(&stored).Error
+	if err != nil || len(stored) == 0 {
+		return "", err
+	}
+	switch {
+	case stored[0].Strings:
+		return "collection_string", nil
+	case stored[0].Ints:
+		return "collection_int", nil
+	}
+	return "", nil
+}
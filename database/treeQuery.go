@@ -0,0 +1,206 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// TreeQuery orders the children of a node of the SafeRow tree by key or by the value of one of their
+// descendants, then keeps those between StartAt and EndAt and the first or last ones.
+// Values are ordered like in Firebase: null, false, true, numbers, strings then objects, ties by key.
+type TreeQuery struct {
+	// OrderByChild is the slash separated path, under each child, of the value it is ordered by
+	OrderByChild string `json:"orderByChild,omitempty"`
+	// OrderByKey orders the children by key, integer keys first. It is the default ordering.
+	OrderByKey bool `json:"orderByKey,omitempty"`
+	// StartAt and EndAt are inclusive bounds on the ordered value, or on the key with OrderByKey
+	StartAt interface{} `json:"startAt,omitempty"`
+	EndAt   interface{} `json:"endAt,omitempty"`
+	// LimitToFirst and LimitToLast keep the first or last children of the ordered range
+	LimitToFirst int `json:"limitToFirst,omitempty"`
+	LimitToLast  int `json:"limitToLast,omitempty"`
+}
+
+// ErrInvalidTreeQuery is returned when the options of a TreeQuery cannot be combined or a bound is invalid
+var ErrInvalidTreeQuery = errors.New("invalid tree query")
+
+// TreeChild is a child of the queried node with its whole subtree
+type TreeChild struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// integerLabel matches the keys ordered as numbers by OrderByKey
+var integerLabel = regexp.MustCompile(`^[0-9]{1,10}$`)
+
+// QueryTree returns the ordered children of the node at the ltree path matching the query
+func QueryTree(db *gorm.DB, path string, query TreeQuery) ([]TreeChild, error) {
+	if query.OrderByKey && query.OrderByChild != "" {
+		return nil, fmt.Errorf("%w: orderByKey and orderByChild cannot be combined", ErrInvalidTreeQuery)
+	}
+	if query.LimitToFirst < 0 || query.LimitToLast < 0 {
+		return nil, fmt.Errorf("%w: limits must be positive", ErrInvalidTreeQuery)
+	}
+	if query.LimitToFirst > 0 && query.LimitToLast > 0 {
+		return nil, fmt.Errorf("%w: limitToFirst and limitToLast cannot be combined", ErrInvalidTreeQuery)
+	}
+
+	level := nlevel(path)
+	args := []interface{}{level + 1, level, path, level}
+	sql := `WITH children AS (
+		SELECT DISTINCT subpath(path, 0, ?) AS child, ltree2text(subpath(path, ?, 1)) AS key
+		FROM realtime.safe_rows WHERE path <@ ?::ltree AND nlevel(path) > ?
+	) `
+
+	// rank, num and str give the position of a child, rank being the type of its value
+	var ordered string
+	var bound func(value interface{}) ([]interface{}, error)
+	if query.OrderByChild == "" {
+		ordered = `SELECT child, key,
+			CASE WHEN key ~ '^[0-9]{1,10}$' THEN 0 ELSE 1 END AS rank,
+			CASE WHEN key ~ '^[0-9]{1,10}$' THEN key::numeric ELSE 0 END AS num,
+			key AS str
+			FROM children`
+		bound = keyBound
+	} else {
+		child := TreePathToLTree(query.OrderByChild)
+		if child == "" {
+			return nil, fmt.Errorf("%w: orderByChild requires a path", ErrInvalidTreeQuery)
+		}
+		ordered = `SELECT c.child, c.key,
+			CASE
+				WHEN v.path IS NULL THEN CASE WHEN EXISTS (SELECT 1 FROM realtime.safe_rows d WHERE d.path <@ (c.child || ?::ltree)) THEN 5 ELSE 0 END
+				WHEN v.null_value THEN 0
+				WHEN v.boolean_value IS NOT NULL THEN CASE WHEN v.boolean_value THEN 2 ELSE 1 END
+				WHEN COALESCE(v.int_value::numeric, v.bigint_value::numeric, v.float_value::numeric, v.numeric_value) IS NOT NULL THEN 3
+				WHEN COALESCE(v.text_value, v.uuid_value::text) IS NOT NULL THEN 4
+				ELSE 5
+			END AS rank,
+			COALESCE(v.int_value::numeric, v.bigint_value::numeric, v.float_value::numeric, v.numeric_value, 0) AS num,
+			COALESCE(v.text_value, v.uuid_value::text, '') AS str
+			FROM children c LEFT JOIN realtime.safe_rows v ON v.path = c.child || ?::ltree`
+		args = append(args, child, child)
+		bound = valueBound
+	}
+	sql += "SELECT child::text, key FROM (" + ordered + ") ordered"
+
+	conditions := make([]string, 0, 2)
+	for _, b := range []struct {
+		value      interface{}
+		comparison string
+	}{{query.StartAt, ">="}, {query.EndAt, "<="}} {
+		if b.value == nil {
+			continue
+		}
+		boundArgs, err := bound(b.value)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, "(rank, num, str) "+b.comparison+" (?, ?::numeric, ?)")
+		args = append(args, boundArgs...)
+	}
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	// the last children are read in reverse order, then put back in order
+	direction := "ASC"
+	if query.LimitToLast > 0 {
+		direction = "DESC"
+	}
+	sql += " ORDER BY rank " + direction + ", num " + direction + ", str " + direction + ", key " + direction
+	if limit := query.LimitToFirst + query.LimitToLast; limit > 0 {
+		sql += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	var matches []struct {
+		Child string
+		Key   string
+	}
+	if err := db.Raw(sql, args...).Scan(&matches).Error; err != nil {
+		return nil, err
+	}
+	if query.LimitToLast > 0 {
+		for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+			matches[i], matches[j] = matches[j], matches[i]
+		}
+	}
+	if len(matches) == 0 {
+		return []TreeChild{}, nil
+	}
+
+	// read the subtrees of the matching children at once
+	children := make(pq.StringArray, 0, len(matches))
+	for _, match := range matches {
+		children = append(children, match.Child)
+	}
+	rows := make([]*SafeRow, 0)
+	if err := db.Where("?::ltree[] @> path", children).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	subtrees := make(map[string][]*SafeRow, len(matches))
+	for _, row := range rows {
+		labels := strings.SplitN(string(row.Path), ".", level+2)
+		child := strings.Join(labels[:level+1], ".")
+		subtrees[child] = append(subtrees[child], row)
+	}
+
+	result := make([]TreeChild, 0, len(matches))
+	for _, match := range matches {
+		value, err := FormatSubtree(subtrees[match.Child], match.Child)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, TreeChild{Key: DecodeLabel(match.Key), Value: value})
+	}
+	return result, nil
+}
+
+// valueBound returns the rank, num and str of a bound on the values of the children
+func valueBound(value interface{}) ([]interface{}, error) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return []interface{}{2, "0", ""}, nil
+		}
+		return []interface{}{1, "0", ""}, nil
+	case string:
+		return []interface{}{4, "0", v}, nil
+	case json.Number:
+		return []interface{}{3, v.String(), ""}, nil
+	}
+	if f, ok := asFloat64(value); ok {
+		return []interface{}{3, strconv.FormatFloat(f, 'g', -1, 64), ""}, nil
+	}
+	return nil, fmt.Errorf("%w: a bound must be a boolean, a number or a string", ErrInvalidTreeQuery)
+}
+
+// keyBound returns the rank, num and str of a bound on the keys of the children
+func keyBound(value interface{}) ([]interface{}, error) {
+	var key string
+	switch v := value.(type) {
+	case string:
+		key = v
+	case json.Number:
+		key = v.String()
+	default:
+		f, ok := asFloat64(value)
+		if !ok {
+			return nil, fmt.Errorf("%w: a key bound must be a string", ErrInvalidTreeQuery)
+		}
+		key = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	label := EncodeLabel(key)
+	if integerLabel.MatchString(label) {
+		return []interface{}{0, label, label}, nil
+	}
+	return []interface{}{1, "0", label}, nil
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// TreeReadOptions limit how much of a subtree a read returns
+type TreeReadOptions struct {
+	// Shallow only returns the keys of the children of the path, each set to true
+	Shallow bool
+	// Depth is the number of levels returned below the path, 0 meaning the whole subtree.
+	// The nodes of the last level having children are set to true.
+	Depth int
+}
+
+// ReadTree reads the JSON value stored at the ltree path within the limits of the options,
+// found is false when nothing is stored under it
+func ReadTree(db *gorm.DB, path string, options TreeReadOptions) (interface{}, bool, error) {
+	if options.Shallow && options.Depth != 0 {
+		return nil, false, fmt.Errorf("shallow and depth cannot be combined")
+	}
+	if options.Depth < 0 {
+		return nil, false, fmt.Errorf("depth must be positive")
+	}
+	if options.Shallow {
+		return readShallow(db, path)
+	}
+
+	rows := make([]*SafeRow, 0)
+	query := StartWith(path, db)
+	if options.Depth > 0 {
+		query = query.Where("nlevel(path) <= ?", nlevel(path)+options.Depth)
+	}
+	if err := query.Find(&rows).Error; err != nil {
+		return nil, false, err
+	}
+
+	if options.Depth > 0 {
+		// the nodes of the last level with children hold a placeholder instead of their subtree
+		truncated, err := subpathsBelow(db, path, nlevel(path)+options.Depth)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(truncated) > 0 {
+			placeholders := make(map[string]struct{}, len(truncated))
+			for _, node := range truncated {
+				placeholders[node] = struct{}{}
+			}
+			kept := rows[:0]
+			for _, row := range rows {
+				if _, ok := placeholders[string(row.Path)]; !ok {
+					kept = append(kept, row)
+				}
+			}
+			rows = kept
+			for _, node := range truncated {
+				rows = append(rows, placeholderRow(node))
+			}
+		}
+	}
+
+	if len(rows) == 0 {
+		return nil, false, nil
+	}
+	data, err := FormatSubtree(rows, path)
+	return data, true, err
+}
+
+// readShallow returns the value of a leaf, or the keys of the children of the path set to true
+func readShallow(db *gorm.DB, path string) (interface{}, bool, error) {
+	children, err := subpathsAt(db, path, nlevel(path)+1)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(children) == 0 {
+		rows := make([]*SafeRow, 0)
+		if err := Equals(path, db).Find(&rows).Error; err != nil {
+			return nil, false, err
+		}
+		if len(rows) == 0 {
+			return nil, false, nil
+		}
+		if rows[0].Array {
+			return []interface{}{}, true, nil
+		}
+		value, err := rows[0].GetTheNonNullValue()
+		return value, true, err
+	}
+
+	keys := make(map[string]interface{}, len(children))
+	for _, child := range children {
+		keys[DecodeLabel(child[strings.LastIndex(child, ".")+1:])] = true
+	}
+	return keys, true, nil
+}
+
+// subpathsBelow returns the distinct ancestors, at the given level, of the rows stored deeper under path
+func subpathsBelow(db *gorm.DB, path string, level int) ([]string, error) {
+	nodes := make([]string, 0)
+	err := db.Raw(
+		"SELECT DISTINCT subpath(path, 0, ?) FROM realtime.safe_rows WHERE path <@ ?::ltree AND nlevel(path) > ?",
+		level, path, level,
+	).Scan(&nodes).Error
+	return nodes, err
+}
+
+// subpathsAt returns the distinct ancestors, at the given level, of the rows stored at that level or deeper under path
+func subpathsAt(db *gorm.DB, path string, level int) ([]string, error) {
+	nodes := make([]string, 0)
+	err := db.Raw(
+		"SELECT DISTINCT subpath(path, 0, ?) FROM realtime.safe_rows WHERE path <@ ?::ltree AND nlevel(path) >= ?",
+		level, path, level,
+	).Scan(&nodes).Error
+	return nodes, err
+}
+
+func placeholderRow(path string) *SafeRow {
+	placeholder := true
+	return &SafeRow{Path: LTree(path), Boolean: &placeholder}
+}
+
+// nlevel returns the number of labels of an ltree path, like the Postgres function
+func nlevel(path string) int {
+	if path == "" {
+		return 0
+	}
+	return strings.Count(path, ".") + 1
+}
@@ -0,0 +1,294 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Sentinel keys of the typed values accepted in tree payloads, e.g. {"avatar": {"$binary": "aGVsbG8="}}
+// or {"location": {"$geopoint": {"lat": 48.85, "lng": 2.35}}}. They are read back in the same form.
+const (
+	BinaryValue   = "$binary"
+	GeoPointValue = "$geopoint"
+)
+
+// ArrayMarker is the generated value of an array path, its elements are stored as children labelled 0, 1, ...
+type ArrayMarker struct{}
+
+// IsNativeArray reports whether the array is stored as a single value, in the text[] or integer[] column
+func IsNativeArray(values []interface{}) bool {
+	if len(values) == 0 {
+		return false
+	}
+	if _, ok := stringArray(values); ok {
+		return true
+	}
+	_, ok := int32Array(values)
+	return ok
+}
+
+// uuidPattern only matches the canonical lower case form so that a UUID reads back exactly as written
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// Decimal is an arbitrary precision number kept in its textual form
+type Decimal string
+
+func (d *Decimal) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*d = ""
+	case string:
+		*d = Decimal(v)
+	case []byte:
+		*d = Decimal(v)
+	default:
+		*d = Decimal(fmt.Sprint(v))
+	}
+	return nil
+}
+
+func (d Decimal) Value() (driver.Value, error) {
+	return string(d), nil
+}
+
+// GeoPoint is stored as a Postgres point, x being the longitude and y the latitude
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+func (g *GeoPoint) Scan(value interface{}) error {
+	var raw string
+	switch v := value.(type) {
+	case string:
+		raw = v
+	case []byte:
+		raw = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a geo point", value)
+	}
+	_, err := fmt.Sscanf(raw, "(%g,%g)", &g.Lng, &g.Lat)
+	return err
+}
+
+func (g GeoPoint) Value() (driver.Value, error) {
+	return fmt.Sprintf("(%s,%s)", strconv.FormatFloat(g.Lng, 'g', -1, 64), strconv.FormatFloat(g.Lat, 'g', -1, 64)), nil
+}
+
+// IsTypedValue reports whether the value is a $binary or $geopoint object, stored as a single value
+func IsTypedValue(value interface{}) bool {
+	_, ok := typedBinary(value)
+	if ok {
+		return true
+	}
+	_, ok = typedGeoPoint(value)
+	return ok
+}
+
+func typedBinary(value interface{}) ([]byte, bool) {
+	object, ok := value.(map[string]interface{})
+	if !ok || len(object) != 1 {
+		return nil, false
+	}
+	encoded, ok := object[BinaryValue].(string)
+	if !ok {
+		return nil, false
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	// only the canonical encoding is accepted, it is the one read back
+	if err != nil || base64.StdEncoding.EncodeToString(data) != encoded {
+		return nil, false
+	}
+	return data, true
+}
+
+func typedGeoPoint(value interface{}) (*GeoPoint, bool) {
+	object, ok := value.(map[string]interface{})
+	if !ok || len(object) != 1 {
+		return nil, false
+	}
+	coordinates, ok := object[GeoPointValue].(map[string]interface{})
+	if !ok || len(coordinates) != 2 {
+		return nil, false
+	}
+	lat, okLat := asFloat64(coordinates["lat"])
+	lng, okLng := asFloat64(coordinates["lng"])
+	if !okLat || !okLng || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return nil, false
+	}
+	return &GeoPoint{Lat: lat, Lng: lng}, true
+}
+
+// setSafeRowValue stores the value in the column matching its JSON type. Numbers go to the
+// narrowest column holding them exactly, and values without a dedicated column are kept as jsonb.
+func setSafeRowValue(row *SafeRow, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		row.Null = true
+	case ArrayMarker:
+		row.Array = true
+	case bool:
+		row.Boolean = &v
+	case string:
+		if uuidPattern.MatchString(v) {
+			row.UUID = &v
+		} else {
+			row.Text = &v
+		}
+	case time.Time:
+		row.Timestamp = &v
+	case json.Number:
+		setSafeRowNumber(row, v)
+	case int:
+		setSafeRowNumber(row, json.Number(strconv.Itoa(v)))
+	case int32:
+		row.Int = &v
+	case int64:
+		setSafeRowNumber(row, json.Number(strconv.FormatInt(v, 10)))
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("%v is not a JSON number", v)
+		}
+		setSafeRowNumber(row, json.Number(strconv.FormatFloat(v, 'g', -1, 64)))
+	case []interface{}:
+		return setSafeRowArray(row, v)
+	default:
+		if data, ok := typedBinary(value); ok {
+			row.Binary = data
+			return nil
+		}
+		if point, ok := typedGeoPoint(value); ok {
+			row.GeoPoint = point
+			return nil
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		row.JSON = encoded
+	}
+	return nil
+}
+
+func setSafeRowNumber(row *SafeRow, number json.Number) {
+	text := number.String()
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		if i >= math.MinInt32 && i <= math.MaxInt32 {
+			i32 := int32(i)
+			row.Int = &i32
+		} else {
+			row.BigInt = &i
+		}
+		return
+	}
+	// a float is only used when it holds the exact value of the number, otherwise it is kept as numeric
+	exact, ok := new(big.Rat).SetString(text)
+	if f, err := strconv.ParseFloat(text, 64); ok && err == nil && !math.IsInf(f, 0) {
+		if approximated := new(big.Rat).SetFloat64(f); approximated != nil && approximated.Cmp(exact) == 0 {
+			row.Float = &f
+			return
+		}
+	}
+	decimal := Decimal(text)
+	row.Numeric = &decimal
+}
+
+// setSafeRowArray uses the native array columns for arrays of strings or of 32 bits integers,
+// any other array is kept as jsonb
+func setSafeRowArray(row *SafeRow, values []interface{}) error {
+	if len(values) > 0 {
+		if strs, ok := stringArray(values); ok {
+			row.CollectionString = strs
+			return nil
+		}
+		if ints, ok := int32Array(values); ok {
+			row.CollectionInt = ints
+			return nil
+		}
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	row.JSON = encoded
+	return nil
+}
+
+func stringArray(values []interface{}) ([]string, bool) {
+	strs := make([]string, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
+		}
+		strs = append(strs, s)
+	}
+	return strs, true
+}
+
+func int32Array(values []interface{}) ([]int32, bool) {
+	ints := make([]int32, 0, len(values))
+	for _, v := range values {
+		i, ok := asInt64(v)
+		if !ok || i < math.MinInt32 || i > math.MaxInt32 {
+			return nil, false
+		}
+		ints = append(ints, int32(i))
+	}
+	return ints, true
+}
+
+// asInt64 returns the value of an integral JSON number
+func asInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		i, err := strconv.ParseInt(v.String(), 10, 64)
+		return i, err == nil
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+// asFloat64 returns the value of a JSON number as a float
+func asFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// isJSONNumber reports whether the value is a number, whatever the decoder used
+func isJSONNumber(value interface{}) bool {
+	if _, ok := value.(json.Number); ok {
+		return true
+	}
+	_, ok := asFloat64(value)
+	return ok
+}
@@ -8,11 +8,9 @@ import (
 	"strings"
 
 	"safestore/controllers"
-	"safestore/database"
 	"safestore/utils"
 
 	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
 )
 
 func init() {
@@ -25,114 +23,65 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	upgrader := websocket.Upgrader{}
+	// deliver changes made by every safestore instance to our websocket clients
+	manager.StartChangeFeed()
 
 	r.HandleFunc("/realtime", func(w http.ResponseWriter, r *http.Request) {
-		c, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		defer c.Close()
-		userID, err := utils.GenerateRandomString()
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		manager.WebsocketManager.AddClient(userID, c)
-		jsonOp := utils.WebSocketQuery{}
-	outer:
-		for {
-			// read json message
-			err := c.ReadJSON(&jsonOp)
-			if err != nil {
-				log.Println("read:", err)
-				manager.WebsocketManager.RemoveClient(userID)
-				break
-			}
-
-			switch jsonOp.Op {
-			case utils.AuthOp: // Authentication operation
-				authPayload := jsonOp.Data.(utils.AuthPayload)
-
-				if authPayload.Token != "" && authPayload.Token == "supersecret" {
-					c.WriteJSON(utils.WebSocketQuery{Op: 0, Data: "Authorized"})
-				} else {
-					c.WriteJSON(utils.WebSocketQuery{Op: 0, Data: "Unauthorized"})
-					manager.WebsocketManager.RemoveClient(userID)
-					c.Close()
-					break outer
-				}
-			case utils.InsertOp: // Insert operation in the database
-				crudPayload := jsonOp.Data.(utils.CrudPayload)
-				var paths []map[string]interface{}
-				utils.GeneratePaths(crudPayload.Data, crudPayload.Path, &paths)
-				err = database.InsertInSafeRow(manager.DB, &paths)
-				if err != nil {
-					log.Println(err)
-					c.WriteJSON(utils.WebSocketQuery{Op: 0, Data: err.Error()})
-				}
-				manager.WebsocketManager.Broadcast(jsonOp)
-			case utils.DeleteOp: // Delete operation in the database
-				crudPayload := jsonOp.Data.(utils.CrudPayload)
-				err := database.DeleteInSafeRow(manager.DB, &crudPayload.Path)
-				if err != nil {
-					c.WriteJSON(utils.WebSocketQuery{Op: 0, Data: err.Error()})
-				} else {
-					manager.WebsocketManager.Broadcast(jsonOp)
-				}
-			case utils.GetOp:
-				crudPayload := jsonOp.Data.(utils.CrudPayload)
-				rows := make([]*database.SafeRow, 0)
-				path := crudPayload.Path
-				var err error
-
-				if path == "" {
-					err = manager.DB.Find(&rows).Error
-				} else {
-					err = database.StartWith(strings.ReplaceAll(path, "/", "."), manager.DB).Find(&rows).Error
-				}
-				if err != nil {
-					c.WriteJSON(utils.WebSocketQuery{
-						Op: 500,
-						Data: map[string]interface{}{
-							"error": err.Error(),
-						},
-					})
-				}
+		controllers.RealtimeController(w, r, manager)
+	})
 
-				data, err := database.FormatChildrenRecursive(rows, path)
-				if err != nil {
-					c.WriteJSON(utils.WebSocketQuery{
-						Op: 500,
-						Data: map[string]interface{}{
-							"error": err.Error(),
-						},
-					})
-				}
+	r.HandleFunc("/transaction/read", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		controllers.TransactionReadController(w, r, manager)
+	}).Methods(http.MethodPost)
 
-				manager.WebsocketManager.Broadcast(utils.WebSocketQuery{
-					Op:   200,
-					Data: data,
-				})
+	r.HandleFunc("/transaction/commit", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		controllers.TransactionCommitController(w, r, manager)
+	}).Methods(http.MethodPost)
 
-			}
-			err = c.WriteJSON(jsonOp)
-			if err != nil {
-				log.Println("write:", err)
-				break
-			}
+	tree := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			controllers.TreeGetController(w, r, manager)
+			return
+		case http.MethodPut:
+			controllers.TreePutController(w, r, manager)
+			return
+		case http.MethodPatch:
+			controllers.TreePatchController(w, r, manager)
+			return
+		case http.MethodDelete:
+			controllers.TreeDeleteController(w, r, manager)
+			return
 		}
-	})
+		utils.FormatHttpError(w, http.StatusNotImplemented, "Not implemented", "This endpoint is not implemented yet")
+	}
+	r.HandleFunc(controllers.TreePrefix, tree)
+	r.PathPrefix(controllers.TreePrefix + "/").HandlerFunc(tree)
 
 	r.PathPrefix("/database/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		if r.Method == http.MethodGet {
-			controllers.GetController(w, r, manager.DB)
+		switch r.Method {
+		case http.MethodGet:
+			controllers.GetController(w, r, manager)
+			return
+		case http.MethodPost:
+			if strings.HasSuffix(r.URL.Path, controllers.QuerySuffix) {
+				controllers.QueryController(w, r, manager)
+				return
+			}
+			controllers.PostController(w, r, manager)
+			return
+		case http.MethodPut:
+			controllers.PutController(w, r, manager)
+			return
+		case http.MethodPatch:
+			controllers.PatchController(w, r, manager)
 			return
-		} else if r.Method == http.MethodPost {
-			controllers.PostController(w, r, manager.DB)
+		case http.MethodDelete:
+			controllers.DeleteController(w, r, manager)
 			return
 		}
 		utils.FormatHttpError(w, http.StatusNotImplemented, "Not implemented", "This endpoint is not implemented yet")
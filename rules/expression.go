@@ -0,0 +1,394 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// expression is a compiled rule condition, e.g. `auth != null && auth.uid == uid`.
+// It supports literals (true, false, null, numbers and quoted strings), variables with
+// member access (`auth.uid`, `newData["owner"]`), comparisons, `!`, `&&`, `||` and parentheses.
+type expression interface {
+	eval(vars map[string]interface{}) interface{}
+}
+
+type literal struct {
+	value interface{}
+}
+
+type variable struct {
+	name string
+}
+
+type member struct {
+	target expression
+	key    expression
+}
+
+type not struct {
+	operand expression
+}
+
+type binary struct {
+	op          string
+	left, right expression
+}
+
+func (l literal) eval(map[string]interface{}) interface{} {
+	return l.value
+}
+
+func (v variable) eval(vars map[string]interface{}) interface{} {
+	return vars[v.name]
+}
+
+func (m member) eval(vars map[string]interface{}) interface{} {
+	target, ok := m.target.eval(vars).(map[string]interface{})
+	if !ok {
+		// accessing a member of null or of a scalar is null, so `auth.uid` is safe for anonymous callers
+		return nil
+	}
+	key, ok := m.key.eval(vars).(string)
+	if !ok {
+		return nil
+	}
+	return target[key]
+}
+
+func (n not) eval(vars map[string]interface{}) interface{} {
+	return !isTrue(n.operand.eval(vars))
+}
+
+func (b binary) eval(vars map[string]interface{}) interface{} {
+	switch b.op {
+	case "&&":
+		return isTrue(b.left.eval(vars)) && isTrue(b.right.eval(vars))
+	case "||":
+		return isTrue(b.left.eval(vars)) || isTrue(b.right.eval(vars))
+	}
+
+	left, right := b.left.eval(vars), b.right.eval(vars)
+	switch b.op {
+	case "==":
+		return equals(left, right)
+	case "!=":
+		return !equals(left, right)
+	}
+
+	cmp, ok := compare(left, right)
+	if !ok {
+		return false
+	}
+	switch b.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func isTrue(value interface{}) bool {
+	b, ok := value.(bool)
+	return ok && b
+}
+
+func equals(a, b interface{}) bool {
+	if cmp, ok := compare(a, b); ok {
+		return cmp == 0
+	}
+	switch a := a.(type) {
+	case nil:
+		return b == nil
+	case bool:
+		b, ok := b.(bool)
+		return ok && a == b
+	}
+	return false
+}
+
+// compare orders two numbers or two strings
+func compare(a, b interface{}) (int, bool) {
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	x, okA := a.(string)
+	y, okB := b.(string)
+	if okA && okB {
+		return strings.Compare(x, y), true
+	}
+	return 0, false
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+type token struct {
+	kind  string // "ident", "number", "string" or the operator itself
+	value string
+}
+
+func tokenize(source string) ([]token, error) {
+	tokens := make([]token, 0)
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i < len(runes) && (runes[i] == '_' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: "ident", value: string(runes[start:i])})
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: "number", value: string(runes[start:i])})
+		case r == '"' || r == '\'':
+			var value strings.Builder
+			i++
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string in %q", source)
+			}
+			i++
+			tokens = append(tokens, token{kind: "string", value: value.String()})
+		default:
+			two := ""
+			if i+1 < len(runes) {
+				two = string(runes[i : i+2])
+			}
+			switch two {
+			case "==", "!=", "<=", ">=", "&&", "||":
+				tokens = append(tokens, token{kind: two})
+				i += 2
+				continue
+			}
+			switch r {
+			case '!', '<', '>', '(', ')', '[', ']', '.':
+				tokens = append(tokens, token{kind: string(r)})
+				i++
+			default:
+				return nil, fmt.Errorf("unexpected character %q in %q", r, source)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func compileExpression(source string) (expression, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in %q", p.tokens[p.pos].kind, source)
+	}
+	return expr, nil
+}
+
+func (p *parser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos].kind
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	p.pos++
+	return t
+}
+
+func (p *parser) expect(kind string) error {
+	if p.peek() != kind {
+		return fmt.Errorf("expected %q", kind)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *parser) parseOr() (expression, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = binary{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (expression, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = binary{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (expression, error) {
+	if p.peek() == "!" {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return not{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (expression, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return binary{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parsePrimary() (expression, error) {
+	var expr expression
+	switch p.peek() {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "(":
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		expr = inner
+	case "number":
+		value, err := strconv.ParseFloat(p.next().value, 64)
+		if err != nil {
+			return nil, err
+		}
+		expr = literal{value: value}
+	case "string":
+		expr = literal{value: p.next().value}
+	case "ident":
+		switch name := p.next().value; name {
+		case "true":
+			expr = literal{value: true}
+		case "false":
+			expr = literal{value: false}
+		case "null":
+			expr = literal{value: nil}
+		default:
+			expr = variable{name: name}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected %q", p.peek())
+	}
+
+	// member access: a.b or a["b"]
+	for {
+		switch p.peek() {
+		case ".":
+			p.next()
+			if p.peek() != "ident" {
+				return nil, fmt.Errorf("expected a member name after '.'")
+			}
+			expr = member{target: expr, key: literal{value: p.next().value}}
+		case "[":
+			p.next()
+			key, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			expr = member{target: expr, key: key}
+		default:
+			return expr, nil
+		}
+	}
+}
+
+func isIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package rules
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected []token
+	}{
+		{"auth != null", []token{{kind: "ident", value: "auth"}, {kind: "!="}, {kind: "ident", value: "null"}}},
+		{"a.b_1>=2.5", []token{{kind: "ident", value: "a"}, {kind: "."}, {kind: "ident", value: "b_1"}, {kind: ">="}, {kind: "number", value: "2.5"}}},
+		{`x["o\"k"]`, []token{{kind: "ident", value: "x"}, {kind: "["}, {kind: "string", value: `o"k`}, {kind: "]"}}},
+		{"'a'||!b", []token{{kind: "string", value: "a"}, {kind: "||"}, {kind: "!"}, {kind: "ident", value: "b"}}},
+		{"  ", []token{}},
+	}
+	for _, test := range tests {
+		t.Run(test.source, func(t *testing.T) {
+			tokens, err := tokenize(test.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tokens, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, tokens)
+			}
+		})
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	for _, source := range []string{
+		`"unterminated`,
+		"a = b",
+		"a &&",
+		"(a",
+		"a b",
+		"a.",
+		"a[1",
+	} {
+		t.Run(source, func(t *testing.T) {
+			if _, err := compileExpression(source); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestEval(t *testing.T) {
+	vars := map[string]interface{}{
+		"auth":    nil,
+		"user":    map[string]interface{}{"uid": "alice", "age": 42.0, "admin": true},
+		"uid":     "alice",
+		"newData": map[string]interface{}{"owner": "alice"},
+	}
+	tests := []struct {
+		source   string
+		expected interface{}
+	}{
+		// precedence: comparisons bind tighter than !, ! tighter than && and && tighter than ||
+		{"true || false && false", true},
+		{"(true || false) && false", false},
+		{"!false && false", false},
+		{"!(false && false)", true},
+		{"false || 1 < 2", true},
+		{"!user.admin || uid == 'alice'", true},
+		// member access on null or scalars is null
+		{"auth.uid", nil},
+		{"auth.uid == null", true},
+		{"auth.token.email == null", true},
+		{"uid.length == null", true},
+		{"user.missing.field", nil},
+		// member access
+		{"user.uid == uid", true},
+		{`newData["owner"] == user["uid"]`, true},
+		{"newData[user.uid]", nil},
+		// comparisons
+		{"user.age >= 42", true},
+		{"user.age > 42", false},
+		{"'a' < 'b'", true},
+		{"'1' == 1", false},
+		{"user.age < 'z'", false},
+		{"null == false", false},
+		{"missing == null", true},
+	}
+	for _, test := range tests {
+		t.Run(test.source, func(t *testing.T) {
+			expr, err := compileExpression(test.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := expr.eval(vars); got != test.expected {
+				t.Fatalf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
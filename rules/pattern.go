@@ -0,0 +1,108 @@
+package rules
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// pattern is a compiled path pattern such as `users/{uid}/**`.
+// Segments are literals, `*` (any single segment), `**` (any number of segments),
+// `{name}` (a single segment captured as name) or `{name=**}` (the remaining segments captured as name).
+type pattern struct {
+	segments []patternSegment
+}
+
+// reservedNames are the variables set by Allowed, a capture would shadow them
+var reservedNames = []string{"auth", "newData", "path"}
+
+type patternSegment struct {
+	literal string
+	capture string
+	rest    bool
+	single  bool
+}
+
+func compilePattern(raw string) (*pattern, error) {
+	p := &pattern{}
+	for i, part := range SplitPath(raw) {
+		segment := patternSegment{}
+		switch {
+		case part == "*":
+			segment.single = true
+		case part == "**":
+			segment.rest = true
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := strings.TrimSuffix(strings.TrimPrefix(part, "{"), "}")
+			if captured, ok := strings.CutSuffix(name, "=**"); ok {
+				name = captured
+				segment.rest = true
+			} else {
+				segment.single = true
+			}
+			if !isIdentifier(name) {
+				return nil, fmt.Errorf("invalid capture %q in segment %d", name, i)
+			}
+			if slices.Contains(reservedNames, name) {
+				return nil, fmt.Errorf("capture %q in segment %d uses a reserved name", name, i)
+			}
+			segment.capture = name
+		default:
+			segment.literal = part
+		}
+		p.segments = append(p.segments, segment)
+	}
+	return p, nil
+}
+
+// match returns the captured variables when the path matches the pattern
+func (p *pattern) match(path []string) (map[string]interface{}, bool) {
+	captures := make(map[string]interface{})
+	if !matchSegments(p.segments, path, captures) {
+		return nil, false
+	}
+	return captures, true
+}
+
+func matchSegments(segments []patternSegment, path []string, captures map[string]interface{}) bool {
+	if len(segments) == 0 {
+		return len(path) == 0
+	}
+	segment := segments[0]
+	if segment.rest {
+		// try the longest match first so that captures are as greedy as possible
+		for n := len(path); n >= 0; n-- {
+			if matchSegments(segments[1:], path[n:], captures) {
+				if segment.capture != "" {
+					captures[segment.capture] = strings.Join(path[:n], "/")
+				}
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	if !segment.single && segment.literal != path[0] {
+		return false
+	}
+	if !matchSegments(segments[1:], path[1:], captures) {
+		return false
+	}
+	if segment.capture != "" {
+		captures[segment.capture] = path[0]
+	}
+	return true
+}
+
+// SplitPath splits a slash separated path into its non empty segments
+func SplitPath(path string) []string {
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
@@ -0,0 +1,98 @@
+package rules
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		path     string
+		matched  bool
+		captures map[string]interface{}
+	}{
+		{"users/{uid}", "users/alice", true, map[string]interface{}{"uid": "alice"}},
+		{"users/{uid}", "users/alice/posts", false, nil},
+		{"users/{uid}", "users", false, nil},
+		{"users/*", "users/alice", true, map[string]interface{}{}},
+		{"users/*/posts", "users/alice/posts", true, map[string]interface{}{}},
+		{"users/**", "users", true, map[string]interface{}{}},
+		{"users/**", "users/alice/posts/1", true, map[string]interface{}{}},
+		{"users/**", "rooms/1", false, nil},
+		{"**", "", true, map[string]interface{}{}},
+		{"**/posts", "users/alice/posts", true, map[string]interface{}{}},
+		{"**/posts", "users/alice", false, nil},
+		{"users/{rest=**}", "users", true, map[string]interface{}{"rest": ""}},
+		{"users/{rest=**}", "users/alice/posts/1", true, map[string]interface{}{"rest": "alice/posts/1"}},
+		{"users/{uid}/{rest=**}", "users/alice/posts", true, map[string]interface{}{"uid": "alice", "rest": "posts"}},
+		{"{head=**}/posts/{id}", "a/b/posts/1", true, map[string]interface{}{"head": "a/b", "id": "1"}},
+		{"{head=**}/{tail=**}", "a/b", true, map[string]interface{}{"head": "a/b", "tail": ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern+" "+test.path, func(t *testing.T) {
+			p, err := compilePattern(test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			captures, matched := p.match(SplitPath(test.path))
+			if matched != test.matched {
+				t.Fatalf("expected matched=%v", test.matched)
+			}
+			if matched && !reflect.DeepEqual(captures, test.captures) {
+				t.Fatalf("expected %v, got %v", test.captures, captures)
+			}
+		})
+	}
+}
+
+func TestCompilePatternErrors(t *testing.T) {
+	for _, raw := range []string{
+		"users/{}",
+		"users/{1uid}",
+		"users/{a-b}",
+		"users/{auth}",
+		"users/{newData}",
+		"{path=**}",
+	} {
+		t.Run(raw, func(t *testing.T) {
+			if _, err := compilePattern(raw); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	ruleset, err := Parse([]byte(`{"rules": [
+		{"match": "users/{uid}/**", "read": "auth != null", "write": "auth.uid == uid"},
+		{"match": "public/**", "read": "true"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := map[string]interface{}{"uid": "alice"}
+	tests := []struct {
+		name     string
+		op       Operation
+		path     string
+		auth     map[string]interface{}
+		expected bool
+	}{
+		{"anonymous read", Read, "users/alice", nil, false},
+		{"authenticated read", Read, "users/bob/posts", alice, true},
+		{"owner write", Write, "users/alice/posts/1", alice, true},
+		{"other write", Write, "users/bob", alice, false},
+		{"anonymous write", Write, "users/alice", nil, false},
+		{"public read", Read, "public/news", nil, true},
+		{"no write condition", Write, "public/news", alice, false},
+		{"no rule", Read, "rooms/1", alice, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ruleset.Allowed(test.op, test.path, Context{Auth: test.auth}); got != test.expected {
+				t.Fatalf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
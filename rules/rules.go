@@ -0,0 +1,108 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type Operation string
+
+const (
+	Read  Operation = "read"
+	Write Operation = "write"
+)
+
+// Rule grants an operation on every path matching Match when its condition evaluates to true.
+// A missing condition never grants the operation.
+type Rule struct {
+	Match string `json:"match"`
+	Read  string `json:"read"`
+	Write string `json:"write"`
+
+	pattern *pattern
+	read    expression
+	write   expression
+}
+
+// Ruleset is the list of rules loaded from the rules file:
+//
+//	{"rules": [{"match": "users/{uid}/**", "read": "auth != null", "write": "auth.uid == uid"}]}
+//
+// Conditions can reference the pattern captures, `auth` (null for anonymous callers),
+// `newData` (the written data, null for reads and deletes) and `path`.
+type Ruleset struct {
+	Rules []*Rule `json:"rules"`
+}
+
+// Context holds the caller identity and the incoming data of an operation
+type Context struct {
+	Auth    map[string]interface{}
+	NewData interface{}
+}
+
+func Parse(data []byte) (*Ruleset, error) {
+	ruleset := &Ruleset{}
+	if err := json.Unmarshal(data, ruleset); err != nil {
+		return nil, err
+	}
+	for i, rule := range ruleset.Rules {
+		var err error
+		if rule.pattern, err = compilePattern(rule.Match); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		if rule.Read != "" {
+			if rule.read, err = compileExpression(rule.Read); err != nil {
+				return nil, fmt.Errorf("rule %d read: %w", i, err)
+			}
+		}
+		if rule.Write != "" {
+			if rule.write, err = compileExpression(rule.Write); err != nil {
+				return nil, fmt.Errorf("rule %d write: %w", i, err)
+			}
+		}
+	}
+	return ruleset, nil
+}
+
+func Load(filename string) (*Ruleset, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Allowed reports whether any rule matching the slash separated path grants the operation.
+// A nil ruleset allows everything.
+func (rs *Ruleset) Allowed(op Operation, path string, ctx Context) bool {
+	if rs == nil {
+		return true
+	}
+	segments := SplitPath(path)
+	for _, rule := range rs.Rules {
+		condition := rule.read
+		if op == Write {
+			condition = rule.write
+		}
+		if condition == nil {
+			continue
+		}
+		captures, ok := rule.pattern.match(segments)
+		if !ok {
+			continue
+		}
+
+		vars := captures
+		vars["auth"] = nil
+		if ctx.Auth != nil {
+			vars["auth"] = ctx.Auth
+		}
+		vars["newData"] = ctx.NewData
+		vars["path"] = path
+		if isTrue(condition.eval(vars)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"safestore/rules"
+)
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Identity is the authenticated principal attached to a connection or a request
+type Identity struct {
+	UserID string                 `json:"uid"`
+	Method string                 `json:"method"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+type Authenticator interface {
+	// Authenticate returns the identity owning the credentials or ErrInvalidCredentials
+	Authenticate(credentials string) (*Identity, error)
+}
+
+// Credentials returns the bearer token of the Authorization field, falling back to Token
+func (p AuthPayload) Credentials() string {
+	if token, ok := strings.CutPrefix(p.Authorization, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return p.Token
+}
+
+// APIKeyAuthenticator accepts static API keys, each one bound to a user id
+type APIKeyAuthenticator struct {
+	keys map[string]string
+}
+
+func NewAPIKeyAuthenticator(keys map[string]string) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{keys: keys}
+}
+
+func (a *APIKeyAuthenticator) Authenticate(credentials string) (*Identity, error) {
+	for key, userID := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(credentials)) == 1 {
+			return &Identity{UserID: userID, Method: "apikey"}, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// JWTAuthenticator accepts HMAC signed JWTs (HS256, HS384, HS512) using a local secret
+type JWTAuthenticator struct {
+	secret []byte
+}
+
+func NewJWTAuthenticator(secret []byte) *JWTAuthenticator {
+	return &JWTAuthenticator{secret: secret}
+}
+
+func (a *JWTAuthenticator) Authenticate(credentials string) (*Identity, error) {
+	parts := strings.Split(credentials, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidCredentials
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	var hashFunc func() hash.Hash
+	switch header.Alg {
+	case "HS256":
+		hashFunc = sha256.New
+	case "HS384":
+		hashFunc = sha512.New384
+	case "HS512":
+		hashFunc = sha512.New
+	default:
+		return nil, ErrInvalidCredentials
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	mac := hmac.New(hashFunc, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidCredentials
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now >= exp {
+		return nil, ErrInvalidCredentials
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, ErrInvalidCredentials
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{UserID: subject, Method: "jwt", Claims: claims}, nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ChainAuthenticator tries each authenticator in order and returns the first identity found
+type ChainAuthenticator []Authenticator
+
+func (c ChainAuthenticator) Authenticate(credentials string) (*Identity, error) {
+	if credentials == "" {
+		return nil, ErrInvalidCredentials
+	}
+	for _, authenticator := range c {
+		identity, err := authenticator.Authenticate(credentials)
+		if err == nil {
+			return identity, nil
+		}
+		if !errors.Is(err, ErrInvalidCredentials) {
+			return nil, err
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// NewAuthenticatorFromEnv builds the authenticator configured by
+// SAFESTORE_API_KEYS (`key:uid,key2:uid2`) and SAFESTORE_JWT_SECRET
+func NewAuthenticatorFromEnv() (Authenticator, error) {
+	chain := ChainAuthenticator{}
+
+	if apiKeys := os.Getenv("SAFESTORE_API_KEYS"); apiKeys != "" {
+		keys := make(map[string]string)
+		for _, entry := range strings.Split(apiKeys, ",") {
+			key, userID, ok := strings.Cut(strings.TrimSpace(entry), ":")
+			if !ok || key == "" || userID == "" {
+				return nil, fmt.Errorf("invalid SAFESTORE_API_KEYS entry %q, expected key:uid", entry)
+			}
+			keys[key] = userID
+		}
+		chain = append(chain, NewAPIKeyAuthenticator(keys))
+	}
+
+	if secret := os.Getenv("SAFESTORE_JWT_SECRET"); secret != "" {
+		chain = append(chain, NewJWTAuthenticator([]byte(secret)))
+	}
+
+	if len(chain) == 0 {
+		log.Println("no authenticator configured, every realtime connection will be rejected")
+	}
+	return chain, nil
+}
+
+// AuthenticateRequest returns the identity of the bearer token of the Authorization header.
+// It returns a nil identity for anonymous requests and ErrInvalidCredentials for a rejected token.
+func (s *Manager) AuthenticateRequest(r *http.Request) (*Identity, error) {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return nil, nil
+	}
+	return s.Authenticator.Authenticate(AuthPayload{Authorization: authorization}.Credentials())
+}
+
+// Authorize checks the security rules for an operation on a slash separated path
+func (s *Manager) Authorize(identity *Identity, op rules.Operation, path string, newData interface{}) bool {
+	return s.Rules.Allowed(op, path, rules.Context{Auth: identity.ruleVariables(), NewData: newData})
+}
+
+// ruleVariables exposes the identity as the `auth` variable of the security rules
+func (i *Identity) ruleVariables() map[string]interface{} {
+	if i == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"uid":    i.UserID,
+		"method": i.Method,
+		"token":  i.Claims,
+	}
+}
@@ -0,0 +1,241 @@
+package utils
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"safestore/database"
+	"safestore/rules"
+)
+
+// ChangesChannel is the Postgres NOTIFY channel shared by every safestore instance
+const ChangesChannel = "safestore_changes"
+
+// Postgres rejects NOTIFY payloads of 8000 bytes or more
+const maxNotifyPayload = 7900
+
+const (
+	SafeRowsTable  = "safe_rows"
+	StoreRowsTable = "store_rows"
+)
+
+// ChangeEvent describes a write on realtime.safe_rows or store.store_rows
+type ChangeEvent struct {
+	Table string `json:"table"`
+	Op    OpEnum `json:"op"`
+	// ltree path of the changed SafeRow subtree
+	Path string `json:"path,omitempty"`
+	// ltree paths of the subtrees changed together by a MultiUpdateOp, Data is then keyed by path
+	Paths []string `json:"paths,omitempty"`
+	// collection and id of the changed StoreRow
+	Collection string      `json:"collection,omitempty"`
+	ID         string      `json:"id,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+	// Truncated is set when Data did not fit in the NOTIFY payload, or holds unresolved
+	// field transforms, and has to be read back
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// PublishChange sends the event to every safestore instance, including this one.
+// If the notification cannot be sent the event is only delivered to local clients.
+func (s *Manager) PublishChange(event ChangeEvent) {
+	payload, err := json.Marshal(event)
+	if err == nil && len(payload) > maxNotifyPayload {
+		event.Data = nil
+		event.Truncated = true
+		payload, err = json.Marshal(event)
+	}
+	if err == nil {
+		err = s.Notify(ChangesChannel, string(payload))
+	}
+	if err != nil {
+		log.Printf("error publishing change on %s: %s", ChangesChannel, err)
+		s.dispatchChange(event)
+	}
+}
+
+// StartChangeFeed listens to ChangesChannel in the background and delivers
+// every received event to the websocket clients of this instance
+func (s *Manager) StartChangeFeed() {
+	// register the channel before any reader or writer goroutine uses it
+	s.Listener.addChannel(ChangesChannel)
+
+	go func() {
+		for {
+			err := s.Listen(ChangesChannel)
+			log.Printf("change feed listener stopped: %s, restarting", err)
+			time.Sleep(time.Second)
+		}
+	}()
+
+	go func() {
+		for {
+			payload, err := s.ListenForNextPayload(ChangesChannel)
+			if err != nil {
+				log.Printf("error reading change feed: %s", err)
+				return
+			}
+			var event ChangeEvent
+			if err := unmarshalJSON([]byte(payload), &event); err != nil {
+				log.Printf("invalid change event %q: %s", payload, err)
+				continue
+			}
+			s.dispatchChange(event)
+		}
+	}()
+}
+
+func (s *Manager) dispatchChange(event ChangeEvent) {
+	if event.Table == StoreRowsTable {
+		s.dispatchDocumentChange(event)
+		return
+	}
+	if len(event.Paths) > 0 {
+		s.dispatchMultiPathChange(event)
+		return
+	}
+	if event.Truncated {
+		data, err := s.loadSubtree(event.Path)
+		if err != nil {
+			log.Printf("error loading %s for change event: %s", event.Path, err)
+			return
+		}
+		event.Data = data
+	}
+	s.WebsocketManager.PublishPathsFunc([]string{event.Path}, func(identity *Identity, prefixes []string) []interface{} {
+		if s.Authorize(identity, rules.Read, database.LTreeToTreePath(event.Path), nil) {
+			return []interface{}{treeChange(event.Op, event.Path, event.Data)}
+		}
+		// a subscriber below the changed path only receives its own subtree
+		messages := make([]interface{}, 0)
+		for _, prefix := range prefixes {
+			if !isStrictlyUnderPath(prefix, event.Path) || !s.Authorize(identity, rules.Read, database.LTreeToTreePath(prefix), nil) {
+				continue
+			}
+			data, ok := subtreeAt(event.Data, event.Path, prefix)
+			if !ok && event.Op != DeleteOp {
+				// the merged data does not touch the subtree
+				continue
+			}
+			messages = append(messages, treeChange(event.Op, prefix, data))
+		}
+		return messages
+	})
+}
+
+func treeChange(op OpEnum, path string, data interface{}) WebSocketQuery {
+	return WebSocketQuery{Op: op, Data: map[string]interface{}{"path": path, "data": data}}
+}
+
+func (s *Manager) dispatchMultiPathChange(event ChangeEvent) {
+	if event.Truncated {
+		data := make(map[string]interface{}, len(event.Paths))
+		for _, path := range event.Paths {
+			subtree, err := s.loadSubtree(path)
+			if err != nil {
+				log.Printf("error loading %s for change event: %s", path, err)
+				return
+			}
+			data[path] = subtree
+		}
+		event.Data = data
+	}
+	changes, _ := event.Data.(map[string]interface{})
+	s.WebsocketManager.PublishPathsFunc(event.Paths, func(identity *Identity, prefixes []string) []interface{} {
+		paths := make([]string, 0, len(event.Paths))
+		data := make(map[string]interface{}, len(event.Paths))
+		for _, path := range event.Paths {
+			if s.Authorize(identity, rules.Read, database.LTreeToTreePath(path), nil) {
+				paths = append(paths, path)
+				data[path] = changes[path]
+				continue
+			}
+			// each path replaces its subtree, a subscriber below it receives its own part, null once removed
+			for _, prefix := range prefixes {
+				if !isStrictlyUnderPath(prefix, path) || !s.Authorize(identity, rules.Read, database.LTreeToTreePath(prefix), nil) {
+					continue
+				}
+				paths = append(paths, prefix)
+				data[prefix], _ = subtreeAt(changes[path], path, prefix)
+			}
+		}
+		if len(paths) == 0 {
+			return nil
+		}
+		return []interface{}{WebSocketQuery{
+			Op:   event.Op,
+			Data: map[string]interface{}{"paths": paths, "data": data},
+		}}
+	})
+}
+
+// isStrictlyUnderPath reports whether the ltree path is a descendant of the prefix
+func isStrictlyUnderPath(path, prefix string) bool {
+	return path != prefix && isUnderPath(path, prefix)
+}
+
+// subtreeAt returns the part of the value stored at the ltree path from found at the descendant path to
+func subtreeAt(value interface{}, from string, to string) (interface{}, bool) {
+	relative := to
+	if from != "" {
+		relative = strings.TrimPrefix(to, from+".")
+	}
+	for _, label := range strings.Split(relative, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			child, ok := v[database.DecodeLabel(label)]
+			if !ok {
+				return nil, false
+			}
+			value = child
+		case []interface{}:
+			index, err := strconv.Atoi(label)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func (s *Manager) dispatchDocumentChange(event ChangeEvent) {
+	change := DocumentChange{
+		Collection: event.Collection,
+		ID:         event.ID,
+		Data:       event.Data,
+	}
+	switch event.Op {
+	case InsertOp:
+		change.Type = DocumentAdded
+	case UpdateOp:
+		change.Type = DocumentModified
+	case DeleteOp:
+		change.Type = DocumentRemoved
+	default:
+		log.Printf("unknown document change op %d", event.Op)
+		return
+	}
+
+	if event.Truncated && change.Type != DocumentRemoved {
+		data, err := database.GetInterface(s.DB, event.Collection, event.ID)
+		if err != nil {
+			log.Printf("error loading %s/%s for change event: %s", event.Collection, event.ID, err)
+			return
+		}
+		change.Data = data
+	}
+	s.WebsocketManager.PublishDocument(event.Collection, event.ID, WebSocketQuery{Op: DocumentChangeOp, Data: change})
+	s.LiveQueries.Refresh(s.DB, s.WebsocketManager, event.Collection)
+}
+
+// loadSubtree reads back the value stored under path, a scalar when path is a leaf
+func (s *Manager) loadSubtree(path string) (interface{}, error) {
+	data, _, err := database.ReadSubtree(s.DB, path)
+	return data, err
+}
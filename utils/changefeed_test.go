@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	"safestore/rules"
+)
+
+func TestDispatchReplacedSubtree(t *testing.T) {
+	ruleset, err := rules.Parse([]byte(`{"rules": [
+		{"match": "rooms/**", "read": "auth.uid == 'admin'"},
+		{"match": "rooms/{room}/**", "read": "auth.uid == room"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wm := newTestManager()
+	s := &Manager{WebsocketManager: wm, Rules: ruleset}
+	conns := connect(wm, "admin", "kept", "removed")
+	for id := range conns {
+		wm.SetIdentity(id, &Identity{UserID: id})
+	}
+	wm.Subscribe("admin", "rooms")
+	wm.Subscribe("kept", "rooms.kept")
+	wm.Subscribe("removed", "rooms.removed")
+
+	// a PUT on rooms replacing its children
+	data := map[string]interface{}{"kept": map[string]interface{}{"name": "a"}}
+	s.dispatchChange(ChangeEvent{Table: SafeRowsTable, Op: InsertOp, Paths: []string{"rooms"}, Data: map[string]interface{}{"rooms": data}})
+
+	expected := map[string]interface{}{
+		"admin":   map[string]interface{}{"paths": []string{"rooms"}, "data": map[string]interface{}{"rooms": data}},
+		"kept":    map[string]interface{}{"paths": []string{"rooms.kept"}, "data": map[string]interface{}{"rooms.kept": data["kept"]}},
+		"removed": map[string]interface{}{"paths": []string{"rooms.removed"}, "data": map[string]interface{}{"rooms.removed": nil}},
+	}
+	for id, conn := range conns {
+		wm.SendToUser(id, flush)
+		messages := conn.until(t, flush)
+		if len(messages) != 1 {
+			t.Fatalf("%s: expected one message, got %v", id, messages)
+		}
+		query, ok := messages[0].(WebSocketQuery)
+		if !ok || query.Op != InsertOp || !reflect.DeepEqual(query.Data, expected[id]) {
+			t.Fatalf("%s: expected %v, got %v", id, expected[id], messages[0])
+		}
+	}
+}
@@ -1,7 +1,14 @@
 package utils
 
-import "fmt"
+import (
+	"strconv"
 
+	"safestore/database"
+)
+
+// GeneratePaths flattens the data into {"path": ..., "value": ...} entries, one per stored row.
+// currentPath is an ltree path and every key is escaped with database.EncodeLabel.
+// An array adds an ArrayMarker row at its path and its elements are labelled by their index.
 func GeneratePaths(data interface{}, currentPath string, paths *[]map[string]interface{}) {
 	switch v := data.(type) {
 	case map[string]interface{}:
@@ -10,19 +17,95 @@ func GeneratePaths(data interface{}, currentPath string, paths *[]map[string]int
 			if newPath != "" {
 				newPath += "."
 			}
-			newPath += key
-			// if the value is a map of interface we need to call the function recursively to get all the paths, and we don't add it to the paths
-			if _, ok := value.(map[string]interface{}); !ok {
-				*paths = append(*paths, map[string]interface{}{"path": newPath, "value": value})
-			} else {
-				GeneratePaths(value, newPath, paths)
-			}
+			newPath += database.EncodeLabel(key)
+			generateValuePaths(value, newPath, paths)
 		}
 	case []interface{}:
+		if currentPath != "" {
+			*paths = append(*paths, map[string]interface{}{"path": currentPath, "value": database.ArrayMarker{}})
+		}
 		for i, value := range v {
-			newPath := fmt.Sprintf("%s[%d]", currentPath, i)
-			*paths = append(*paths, map[string]interface{}{"path": newPath, "value": value})
-			GeneratePaths(value, newPath, paths)
+			newPath := strconv.Itoa(i)
+			if currentPath != "" {
+				newPath = currentPath + "." + newPath
+			}
+			generateValuePaths(value, newPath, paths)
+		}
+	}
+}
+
+// generateValuePaths adds the value as a single entry when it is a leaf, otherwise the entries of its children
+func generateValuePaths(value interface{}, path string, paths *[]map[string]interface{}) {
+	if isLeafValue(value) {
+		*paths = append(*paths, map[string]interface{}{"path": path, "value": value})
+		return
+	}
+	GeneratePaths(value, path, paths)
+}
+
+// isLeafValue reports whether the value is stored in a single row
+func isLeafValue(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		// transform sentinels such as {"$increment": 1} and typed values such as {"$binary": "..."} are values of their own,
+		// an empty object has no children to hold it
+		return len(v) == 0 || database.IsTransform(v) || database.IsTypedValue(v)
+	case []interface{}:
+		// arrays of strings or integers use the array columns
+		return database.IsNativeArray(v)
+	}
+	return true
+}
+
+// GenerateUpdatePaths converts a fan-out update (slash separated client path -> value) into the ltree roots
+// it replaces and the paths to insert. A nil value only deletes its root.
+func GenerateUpdatePaths(updates map[string]interface{}) ([]string, []map[string]interface{}) {
+	roots := make([]string, 0, len(updates))
+	paths := make([]map[string]interface{}, 0)
+	for path, value := range updates {
+		root := database.TreePathToLTree(path)
+		roots = append(roots, root)
+		if value != nil {
+			generateValuePaths(value, root, &paths)
+		}
+	}
+	return roots, paths
+}
+
+// GenerateMergePaths converts a partial update of the object at the ltree path root into the values
+// of the paths it replaces, nil deleting the path, and the paths to insert. It follows MergeInterface:
+// nested objects are merged key by key and any other value replaces the child it is set on.
+func GenerateMergePaths(root string, data map[string]interface{}) (map[string]interface{}, []map[string]interface{}) {
+	changes := make(map[string]interface{})
+	paths := make([]map[string]interface{}, 0)
+	generateMergePaths(root, data, changes, &paths)
+	return changes, paths
+}
+
+func generateMergePaths(root string, data map[string]interface{}, changes map[string]interface{}, paths *[]map[string]interface{}) {
+	for key, value := range data {
+		path := database.EncodeLabel(key)
+		if root != "" {
+			path = root + "." + path
+		}
+		if object, ok := value.(map[string]interface{}); ok && !database.IsTransform(object) && !database.IsTypedValue(object) {
+			generateMergePaths(path, object, changes, paths)
+			continue
+		}
+		changes[path] = value
+		if value != nil {
+			generateValuePaths(value, path, paths)
+		}
+	}
+}
+
+// HasTransforms reports whether the generated paths contain a transform sentinel,
+// the written values are then only known once read back from the database
+func HasTransforms(paths []map[string]interface{}) bool {
+	for _, path := range paths {
+		if database.IsTransform(path["value"]) {
+			return true
 		}
 	}
+	return false
 }
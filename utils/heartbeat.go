@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// HeartbeatConfig keeps the realtime connections alive and drops the dead or idle ones.
+// The server pings every PingInterval, a connection which does not answer within PongTimeout
+// is dropped, as is one whose writes take longer than WriteTimeout, or which is not authenticated
+// after AuthTimeout. A zero value disables each of them.
+type HeartbeatConfig struct {
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	WriteTimeout time.Duration
+	AuthTimeout  time.Duration
+	// ReadLimit is the maximum size in bytes of a received message, a larger one closes the connection
+	ReadLimit int64
+}
+
+// DefaultHeartbeat is used when the environment does not configure the heartbeats
+var DefaultHeartbeat = HeartbeatConfig{
+	PingInterval: 30 * time.Second,
+	PongTimeout:  60 * time.Second,
+	WriteTimeout: 10 * time.Second,
+	AuthTimeout:  10 * time.Second,
+	ReadLimit:    1 << 20,
+}
+
+// HeartbeatConfigFromEnv reads SAFESTORE_WS_PING_INTERVAL, SAFESTORE_WS_PONG_TIMEOUT, SAFESTORE_WS_WRITE_TIMEOUT
+// and SAFESTORE_WS_AUTH_TIMEOUT as Go durations (`30s`, `1m`) and SAFESTORE_WS_READ_LIMIT in bytes,
+// falling back to DefaultHeartbeat
+func HeartbeatConfigFromEnv() (HeartbeatConfig, error) {
+	config := DefaultHeartbeat
+	if raw := os.Getenv("SAFESTORE_WS_READ_LIMIT"); raw != "" {
+		limit, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || limit < 0 {
+			return config, fmt.Errorf("invalid SAFESTORE_WS_READ_LIMIT %q, expected a positive number of bytes", raw)
+		}
+		config.ReadLimit = limit
+	}
+	for name, duration := range map[string]*time.Duration{
+		"SAFESTORE_WS_PING_INTERVAL": &config.PingInterval,
+		"SAFESTORE_WS_PONG_TIMEOUT":  &config.PongTimeout,
+		"SAFESTORE_WS_WRITE_TIMEOUT": &config.WriteTimeout,
+		"SAFESTORE_WS_AUTH_TIMEOUT":  &config.AuthTimeout,
+	} {
+		raw := os.Getenv(name)
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed < 0 {
+			return config, fmt.Errorf("invalid %s %q, expected a positive duration", name, raw)
+		}
+		*duration = parsed
+	}
+	if config.PingInterval == 0 && config.PongTimeout > 0 {
+		return config, fmt.Errorf("SAFESTORE_WS_PONG_TIMEOUT requires pings, SAFESTORE_WS_PING_INTERVAL is 0")
+	}
+	if config.PongTimeout > 0 && config.PongTimeout <= config.PingInterval {
+		return config, fmt.Errorf("SAFESTORE_WS_PONG_TIMEOUT must be longer than SAFESTORE_WS_PING_INTERVAL")
+	}
+	return config, nil
+}
+
+// Watch limits the size of the messages read from the connection, sets its read deadline and
+// pushes it back on every pong. A read blocked past the deadline fails and ends the read loop of the connection.
+func (h HeartbeatConfig) Watch(c *websocket.Conn) {
+	if h.ReadLimit > 0 {
+		c.SetReadLimit(h.ReadLimit)
+	}
+	if h.PongTimeout == 0 {
+		return
+	}
+	c.SetReadDeadline(time.Now().Add(h.PongTimeout))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(h.PongTimeout))
+	})
+}
+
+// deadline returns the deadline of a write started now, the zero time when writes are not limited
+func (h HeartbeatConfig) deadline() time.Time {
+	if h.WriteTimeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(h.WriteTimeout)
+}
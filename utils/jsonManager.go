@@ -1,10 +1,12 @@
 package utils
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 )
 
@@ -47,11 +49,26 @@ func FormatHttpError(w http.ResponseWriter, httpCode int, title, message string)
 }
 
 func FormatHttpSuccess(w http.ResponseWriter, data interface{}) {
+	FormatHttpResponse(w, http.StatusOK, data)
+}
+
+func FormatHttpResponse(w http.ResponseWriter, httpCode int, data interface{}) {
 	formated, err := formatJsonToResponse(data)
 	if err != nil {
 		FormatHttpError(w, 500, "Internal server error", err.Error())
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(httpCode)
 	w.Write(formated)
 }
+
+// DecodeJSON decodes numbers as json.Number so that integers beyond 2^53 and decimals are kept exactly
+func DecodeJSON(r io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func unmarshalJSON(data []byte, v interface{}) error {
+	return DecodeJSON(bytes.NewReader(data), v)
+}
@@ -0,0 +1,285 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"safestore/database"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultLiveQueryLimit = 100
+	maxLiveQueryLimit     = 1000
+)
+
+// LiveQueryPayload registers a filtered, ordered and limited query on a collection
+type LiveQueryPayload struct {
+	QueryID    string `json:"queryId"`
+	Collection string `json:"collection"`
+	database.Query
+	OrderBy   string `json:"orderBy"`
+	Direction string `json:"direction"`
+	Limit     int    `json:"limit"`
+}
+
+// LiveQueryDocument is a document of a live query result with its position in the result set
+type LiveQueryDocument struct {
+	ID    string                 `json:"id"`
+	Data  map[string]interface{} `json:"data"`
+	Index int                    `json:"index"`
+}
+
+// LiveQueryResult is the data of a LiveQueryResultOp message, sent once when the query is registered
+type LiveQueryResult struct {
+	QueryID   string              `json:"queryId"`
+	Documents []LiveQueryDocument `json:"documents"`
+}
+
+// LiveQueryDiff is the data of a LiveQueryChangeOp message, sent each time the result set changes
+type LiveQueryDiff struct {
+	QueryID  string              `json:"queryId"`
+	Added    []LiveQueryDocument `json:"added"`
+	Modified []LiveQueryDocument `json:"modified"`
+	Removed  []string            `json:"removed"`
+}
+
+type liveQuery struct {
+	id         string
+	collection string
+	query      database.Query
+	page       database.Page
+	// mu serializes the runs of the query, so that each diff is computed from the previous result set
+	mu sync.Mutex
+	// results holds the encoded data and the position of each document of the last result set
+	results map[string]liveQueryEntry
+	// pending holds at most one refresh, the ones requested while it waits or runs are coalesced with it
+	pending  chan liveQueryRefresh
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type liveQueryRefresh struct {
+	db *gorm.DB
+	wm *WebsocketManager
+}
+
+type liveQueryEntry struct {
+	data  []byte
+	index int
+}
+
+// LiveQueryManager keeps the live queries of the connected clients and their last result sets
+type LiveQueryManager struct {
+	mu sync.Mutex
+	// queries maps a client ID to its live queries by query ID
+	queries map[string]map[string]*liveQuery
+}
+
+func NewLiveQueryManager() *LiveQueryManager {
+	return &LiveQueryManager{
+		queries: make(map[string]map[string]*liveQuery),
+	}
+}
+
+// Register keeps the query to compute the following diffs, then runs it and passes the initial
+// result set to onResult. No diff of the query is sent before onResult returns.
+func (lm *LiveQueryManager) Register(db *gorm.DB, userID string, payload LiveQueryPayload, onResult func(*LiveQueryResult)) error {
+	if payload.QueryID == "" {
+		return fmt.Errorf("queryId is required")
+	}
+	limit := payload.Limit
+	if limit == 0 {
+		limit = defaultLiveQueryLimit
+	}
+	if limit < 0 || limit > maxLiveQueryLimit {
+		return fmt.Errorf("limit must be between 1 and %d", maxLiveQueryLimit)
+	}
+	var descending bool
+	switch payload.Direction {
+	case "", "asc":
+	case "desc":
+		descending = true
+	default:
+		return fmt.Errorf("direction must be asc or desc")
+	}
+
+	query := &liveQuery{
+		id:         payload.QueryID,
+		collection: database.PathToLTree(payload.Collection),
+		query:      payload.Query,
+		page:       database.Page{OrderBy: payload.OrderBy, Descending: descending, Limit: limit},
+		pending:    make(chan liveQueryRefresh, 1),
+		stop:       make(chan struct{}),
+	}
+	// register before the first run so that a write happening meanwhile is diffed afterwards
+	query.mu.Lock()
+	defer query.mu.Unlock()
+	lm.mu.Lock()
+	if _, ok := lm.queries[userID]; !ok {
+		lm.queries[userID] = make(map[string]*liveQuery)
+	}
+	if previous, ok := lm.queries[userID][query.id]; ok {
+		previous.close()
+	}
+	lm.queries[userID][query.id] = query
+	lm.mu.Unlock()
+
+	documents, results, err := query.run(db)
+	if err != nil {
+		lm.unregister(userID, query)
+		return err
+	}
+	query.results = results
+	onResult(&LiveQueryResult{QueryID: query.id, Documents: documents})
+	go query.work(lm, userID)
+	return nil
+}
+
+func (lm *LiveQueryManager) Unregister(userID string, queryID string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if query, ok := lm.queries[userID][queryID]; ok {
+		query.close()
+	}
+	delete(lm.queries[userID], queryID)
+	if len(lm.queries[userID]) == 0 {
+		delete(lm.queries, userID)
+	}
+}
+
+func (lm *LiveQueryManager) RemoveClient(userID string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for _, query := range lm.queries[userID] {
+		query.close()
+	}
+	delete(lm.queries, userID)
+}
+
+// Refresh schedules a new run of every live query on the collection without waiting for it.
+// Each query runs on its own goroutine and sends the changes of its result set to the client owning it,
+// so a slow query delays neither the change feed nor the other queries.
+func (lm *LiveQueryManager) Refresh(db *gorm.DB, wm *WebsocketManager, collection string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for _, queries := range lm.queries {
+		for _, query := range queries {
+			if query.collection == collection {
+				query.schedule(liveQueryRefresh{db: db, wm: wm})
+			}
+		}
+	}
+}
+
+// schedule requests a refresh unless one is already waiting, the waiting one reads the latest data as well
+func (q *liveQuery) schedule(refresh liveQueryRefresh) {
+	select {
+	case q.pending <- refresh:
+	default:
+	}
+}
+
+// work runs the scheduled refreshes of the query until it is closed
+func (q *liveQuery) work(lm *LiveQueryManager, userID string) {
+	for {
+		select {
+		case refresh := <-q.pending:
+			q.refresh(refresh.db, refresh.wm, lm, userID)
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// close stops the worker of the query, a refresh already running completes
+func (q *liveQuery) close() {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+	})
+}
+
+func (q *liveQuery) refresh(db *gorm.DB, wm *WebsocketManager, lm *LiveQueryManager, userID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !lm.registered(userID, q) {
+		return
+	}
+	documents, results, err := q.run(db)
+	if err != nil {
+		log.Printf("error refreshing live query %s of %s: %s", q.id, userID, err)
+		return
+	}
+
+	diff := LiveQueryDiff{
+		QueryID:  q.id,
+		Added:    make([]LiveQueryDocument, 0),
+		Modified: make([]LiveQueryDocument, 0),
+		Removed:  make([]string, 0),
+	}
+	for _, document := range documents {
+		previous, ok := q.results[document.ID]
+		if !ok {
+			diff.Added = append(diff.Added, document)
+		} else if previous.index != document.Index || !bytes.Equal(previous.data, results[document.ID].data) {
+			diff.Modified = append(diff.Modified, document)
+		}
+	}
+	for id := range q.results {
+		if _, ok := results[id]; !ok {
+			diff.Removed = append(diff.Removed, id)
+		}
+	}
+	q.results = results
+
+	if len(diff.Added)+len(diff.Modified)+len(diff.Removed) == 0 {
+		return
+	}
+	if err := wm.SendToUser(userID, WebSocketQuery{Op: LiveQueryChangeOp, Data: diff}); err != nil {
+		log.Printf("error sending live query %s to %s: %s", q.id, userID, err)
+	}
+}
+
+// registered reports whether the query is still the one registered under its id by the client
+func (lm *LiveQueryManager) registered(userID string, query *liveQuery) bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	return lm.queries[userID][query.id] == query
+}
+
+// unregister removes the query unless it was replaced by another one with the same id
+func (lm *LiveQueryManager) unregister(userID string, query *liveQuery) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if lm.queries[userID][query.id] != query {
+		return
+	}
+	query.close()
+	delete(lm.queries[userID], query.id)
+	if len(lm.queries[userID]) == 0 {
+		delete(lm.queries, userID)
+	}
+}
+
+// run executes the query and returns its documents and their entries by id
+func (q *liveQuery) run(db *gorm.DB) ([]LiveQueryDocument, map[string]liveQueryEntry, error) {
+	page, err := database.GetCollectionPage(db, q.collection, q.query, q.page)
+	if err != nil {
+		return nil, nil, err
+	}
+	documents := make([]LiveQueryDocument, 0, len(page.Documents))
+	results := make(map[string]liveQueryEntry, len(page.Documents))
+	for i, document := range page.Documents {
+		encoded, err := json.Marshal(document.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		results[document.ID] = liveQueryEntry{data: encoded, index: i}
+		documents = append(documents, LiveQueryDocument{ID: document.ID, Data: document.Data, Index: i})
+	}
+	return documents, results, nil
+}
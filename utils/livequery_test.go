@@ -0,0 +1,62 @@
+package utils
+
+import "testing"
+
+func newTestLiveQuery(lm *LiveQueryManager, userID string, id string, collection string) *liveQuery {
+	query := &liveQuery{
+		id:         id,
+		collection: collection,
+		pending:    make(chan liveQueryRefresh, 1),
+		stop:       make(chan struct{}),
+	}
+	if _, ok := lm.queries[userID]; !ok {
+		lm.queries[userID] = make(map[string]*liveQuery)
+	}
+	lm.queries[userID][id] = query
+	return query
+}
+
+func TestRefreshCoalescesPerQuery(t *testing.T) {
+	lm := NewLiveQueryManager()
+	rooms := newTestLiveQuery(lm, "a", "q1", "rooms")
+	users := newTestLiveQuery(lm, "a", "q2", "users")
+	otherRooms := newTestLiveQuery(lm, "b", "q1", "rooms")
+
+	// no worker drains the queries, Refresh must not block on them
+	for i := 0; i < 3; i++ {
+		lm.Refresh(nil, nil, "rooms")
+	}
+	if len(rooms.pending) != 1 || len(otherRooms.pending) != 1 {
+		t.Fatalf("expected one pending refresh per query, got %d and %d", len(rooms.pending), len(otherRooms.pending))
+	}
+	if len(users.pending) != 0 {
+		t.Fatal("query on another collection scheduled")
+	}
+}
+
+func TestUnregisterStopsQueries(t *testing.T) {
+	lm := NewLiveQueryManager()
+	q1 := newTestLiveQuery(lm, "a", "q1", "rooms")
+	q2 := newTestLiveQuery(lm, "a", "q2", "rooms")
+	q3 := newTestLiveQuery(lm, "b", "q1", "rooms")
+
+	done := make(chan struct{})
+	go func() {
+		q1.work(lm, "a")
+		close(done)
+	}()
+	lm.Unregister("a", "q1")
+	<-done
+
+	lm.RemoveClient("a")
+	select {
+	case <-q2.stop:
+	default:
+		t.Fatal("query of the removed client not stopped")
+	}
+	select {
+	case <-q3.stop:
+		t.Fatal("query of another client stopped")
+	default:
+	}
+}
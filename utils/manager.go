@@ -3,8 +3,11 @@ package utils
 import (
 	"context"
 	"fmt"
+	"log"
+	"os"
 
 	"safestore/database"
+	"safestore/rules"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"gorm.io/driver/postgres"
@@ -18,6 +21,10 @@ type Manager struct {
 	pgx              *pgxpool.Pool
 	Listener         *mapListener
 	WebsocketManager *WebsocketManager
+	LiveQueries      *LiveQueryManager
+	Authenticator    Authenticator
+	// Rules is nil when no rules file is configured, which leaves every path open
+	Rules *rules.Ruleset
 }
 
 func NewManager() (*Manager, error) {
@@ -43,14 +50,45 @@ func NewManager() (*Manager, error) {
 	if err := gormDB.AutoMigrate(&database.SafeRow{}, &database.StoreRow{}); err != nil {
 		return nil, err
 	}
+	authenticator, err := NewAuthenticatorFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	ruleset, err := loadRules()
+	if err != nil {
+		return nil, err
+	}
+	heartbeat, err := HeartbeatConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	websocketManager := NewWebsocketManager()
+	websocketManager.Heartbeat = heartbeat
 	return &Manager{
 		DB:               gormDB,
 		pgx:              pool,
 		Listener:         newMapListener(),
-		WebsocketManager: NewWebsocketManager(),
+		WebsocketManager: websocketManager,
+		LiveQueries:      NewLiveQueryManager(),
+		Authenticator:    authenticator,
+		Rules:            ruleset,
 	}, nil
 }
 
+// loadRules reads the security rules file pointed by SAFESTORE_RULES
+func loadRules() (*rules.Ruleset, error) {
+	filename := os.Getenv("SAFESTORE_RULES")
+	if filename == "" {
+		log.Println("no security rules configured, every path is readable and writable")
+		return nil, nil
+	}
+	ruleset, err := rules.Load(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rules from %s: %v", filename, err)
+	}
+	return ruleset, nil
+}
+
 func setupDB() (*gorm.DB, *pgxpool.Pool, error) {
 	dsn := "host=localhost user=safeuser password=safepassword dbname=safestore port=5432 sslmode=disable TimeZone=Europe/Paris"
 	// Set up GORM connection
@@ -106,7 +144,6 @@ func (s *Manager) Listen(channel string) error {
 		if err != nil {
 			return fmt.Errorf("error waiting for notification: %v", err)
 		}
-		fmt.Println("Received payload:", notification.Payload)
 		s.Listener.Notify(channel, notification.Payload)
 	}
 }
@@ -15,7 +15,6 @@ func (ml *mapListener) Notify(channel, payload string) error {
 		return fmt.Errorf("channel %s does not exist", channel)
 	}
 
-	fmt.Println("Sending payload to channel", channel)
 	// Send payload to channel
 	ml.listeners[channel] <- payload
 	return nil
@@ -29,7 +28,6 @@ func (ml *mapListener) listenForNextPayload(channel string) (string, error) {
 
 	// Wait for payload
 	payload := <-ml.listeners[channel]
-	fmt.Println("Received payload from channel", payload)
 	return payload, nil
 }
 
@@ -40,6 +38,10 @@ func newMapListener() *mapListener {
 }
 
 func (ml *mapListener) addChannel(channel string) {
+	// keep the existing channel so that readers already waiting on it are not orphaned
+	if _, ok := ml.listeners[channel]; ok {
+		return
+	}
 	ml.listeners[channel] = make(chan string)
 }
 
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"safestore/database"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolVersion is the version of the websocket protocol spoken by this server
+const ProtocolVersion = 1
+
+// Subprotocols are the websocket subprotocols accepted at connect time, the first one requested
+// by the client is used. A client requesting none speaks the current version.
+var Subprotocols = []string{fmt.Sprintf("safestore.v%d", ProtocolVersion)}
+
+var ErrUnsupportedProtocol = errors.New("unsupported protocol version")
+
+// Envelope is a request received from a websocket client. Its payload is decoded according to Op by DecodePayload.
+type Envelope struct {
+	Op OpEnum `json:"op"`
+	// ID is chosen by the client, the reply to the request carries it back
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"data"`
+}
+
+// ProtocolError is a request which does not follow the protocol, it is reported to the client
+// in an error frame and the connection stays open unless CloseCode is set
+type ProtocolError struct {
+	Code    int
+	Message string
+	// CloseCode is the websocket close code ending the connection after the error frame
+	CloseCode int
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
+// payloadTypes creates the payload of each op a client can send
+var payloadTypes = map[OpEnum]func() interface{}{
+	AuthOp:                func() interface{} { return &AuthPayload{} },
+	InsertOp:              func() interface{} { return &CrudPayload{} },
+	DeleteOp:              func() interface{} { return &CrudPayload{} },
+	UpdateOp:              func() interface{} { return &CrudPayload{} },
+	GetOp:                 func() interface{} { return &CrudPayload{} },
+	SubscribeOp:           func() interface{} { return &SubscriptionPayload{} },
+	UnsubscribeOp:         func() interface{} { return &SubscriptionPayload{} },
+	DocumentSubscribeOp:   func() interface{} { return &DocumentSubscriptionPayload{} },
+	DocumentUnsubscribeOp: func() interface{} { return &DocumentSubscriptionPayload{} },
+	LiveQueryOp:           func() interface{} { return &LiveQueryPayload{} },
+	LiveQueryStopOp:       func() interface{} { return &LiveQueryPayload{} },
+	MultiUpdateOp:         func() interface{} { return &MultiUpdatePayload{} },
+	TransactionReadOp:     func() interface{} { return &TransactionReadPayload{} },
+	TransactionCommitOp:   func() interface{} { return &database.Transaction{} },
+	TreeQueryOp:           func() interface{} { return &TreeQueryPayload{} },
+}
+
+// TransactionReadPayload lists the documents read at the start of a transaction
+type TransactionReadPayload struct {
+	Documents []database.DocumentRef `json:"documents"`
+}
+
+// NegotiateProtocol picks the subprotocol of a websocket upgrade request, it returns
+// ErrUnsupportedProtocol when the client only requested versions this server does not speak
+func NegotiateProtocol(r *http.Request) (string, error) {
+	requested := websocket.Subprotocols(r)
+	if len(requested) == 0 {
+		return "", nil
+	}
+	for _, protocol := range requested {
+		for _, supported := range Subprotocols {
+			if protocol == supported {
+				return protocol, nil
+			}
+		}
+	}
+	return "", ErrUnsupportedProtocol
+}
+
+// ReadEnvelope reads the next request of the connection. A message which is not a valid envelope
+// returns a *ProtocolError, any other error means that the connection is lost or timed out.
+func ReadEnvelope(c *websocket.Conn) (Envelope, error) {
+	messageType, message, err := c.ReadMessage()
+	if err != nil {
+		return Envelope{}, err
+	}
+	if messageType != websocket.TextMessage {
+		return Envelope{}, &ProtocolError{
+			Code:      http.StatusBadRequest,
+			Message:   "only text messages are supported",
+			CloseCode: websocket.CloseUnsupportedData,
+		}
+	}
+	return decodeEnvelope(message)
+}
+
+func decodeEnvelope(message []byte) (Envelope, error) {
+	// op is decoded as a pointer, a missing op would otherwise be taken as AuthOp
+	var raw struct {
+		Op      *OpEnum         `json:"op"`
+		ID      string          `json:"id"`
+		Payload json.RawMessage `json:"data"`
+	}
+	if err := unmarshalJSON(message, &raw); err != nil {
+		return Envelope{}, &ProtocolError{Code: http.StatusBadRequest, Message: "malformed message: " + err.Error()}
+	}
+	if raw.Op == nil {
+		return Envelope{}, &ProtocolError{Code: http.StatusBadRequest, Message: "malformed message: missing op"}
+	}
+	return Envelope{Op: *raw.Op, ID: raw.ID, Payload: raw.Payload}, nil
+}
+
+// DecodePayload returns the typed payload of the request, a pointer to one of the *Payload
+// structs depending on its op. Numbers are decoded as json.Number.
+func (e Envelope) DecodePayload() (interface{}, error) {
+	newPayload, ok := payloadTypes[e.Op]
+	if !ok {
+		return nil, &ProtocolError{Code: http.StatusBadRequest, Message: fmt.Sprintf("unknown op %d", e.Op)}
+	}
+	payload := newPayload()
+	if len(e.Payload) == 0 || bytes.Equal(e.Payload, []byte("null")) {
+		return payload, nil
+	}
+	if err := unmarshalJSON(e.Payload, payload); err != nil {
+		return nil, &ProtocolError{Code: http.StatusBadRequest, Message: fmt.Sprintf("malformed payload of op %d: %s", e.Op, err)}
+	}
+	return payload, nil
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestDecodeEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		op      OpEnum
+		id      string
+		invalid bool
+	}{
+		{"auth", `{"op": 0, "id": "1", "data": {}}`, AuthOp, "1", false},
+		{"without id", `{"op": 1}`, InsertOp, "", false},
+		{"missing op", `{"id": "1", "data": {}}`, 0, "", true},
+		{"null op", `{"op": null, "id": "1"}`, 0, "", true},
+		{"string op", `{"op": "auth"}`, 0, "", true},
+		{"not an object", `[0]`, 0, "", true},
+		{"truncated", `{"op": 0`, 0, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envelope, err := decodeEnvelope([]byte(test.message))
+			var protocolErr *ProtocolError
+			if test.invalid {
+				if !errors.As(err, &protocolErr) || protocolErr.CloseCode != 0 {
+					t.Fatalf("expected a ProtocolError keeping the connection, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if envelope.Op != test.op || envelope.ID != test.id {
+				t.Fatalf("expected op %d and id %q, got %+v", test.op, test.id, envelope)
+			}
+		})
+	}
+}
+
+func TestDecodePayload(t *testing.T) {
+	payload, err := Envelope{Op: InsertOp, Payload: []byte(`{"path": "rooms/1", "data": {"n": 12345678901234567890}}`)}.DecodePayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crud, ok := payload.(*CrudPayload)
+	if !ok || crud.Path != "rooms/1" {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+	if number, ok := crud.Data["n"].(json.Number); !ok || number.String() != "12345678901234567890" {
+		t.Fatalf("expected an exact number, got %v", crud.Data["n"])
+	}
+
+	var protocolErr *ProtocolError
+	if _, err := (Envelope{Op: ErrorOp}).DecodePayload(); !errors.As(err, &protocolErr) {
+		t.Fatalf("expected a ProtocolError for an op clients cannot send, got %v", err)
+	}
+	if _, err := (Envelope{Op: InsertOp, Payload: []byte(`"rooms"`)}).DecodePayload(); !errors.As(err, &protocolErr) {
+		t.Fatalf("expected a ProtocolError for a malformed payload, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// clientQueueSize is the number of messages waiting to be written to a client before it is
+// considered too slow and disconnected
+const clientQueueSize = 256
+
+var (
+	ErrClientClosed = errors.New("client closed")
+	ErrSlowConsumer = errors.New("client is too slow, disconnected")
+)
+
+// Conn is the side of a websocket connection written by a Client, *websocket.Conn implements it
+type Conn interface {
+	WriteJSON(v interface{}) error
+	WriteMessage(messageType int, data []byte) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// Client is a websocket connection and the identity it authenticated with, if any.
+// Messages are queued by Send and written by a single goroutine, the only writer of Conn.
+type Client struct {
+	Conn Conn
+	// Identity is guarded by the lock of the WebsocketManager holding the client
+	Identity *Identity
+
+	heartbeat HeartbeatConfig
+	send      chan interface{}
+	done      chan struct{}
+	closeOnce sync.Once
+	// closeCode and closeReason are sent in the close frame, they are set once before done is closed
+	closeCode   int
+	closeReason string
+}
+
+func newClient(conn Conn, heartbeat HeartbeatConfig) *Client {
+	client := &Client{
+		Conn:      conn,
+		heartbeat: heartbeat,
+		send:      make(chan interface{}, clientQueueSize),
+		done:      make(chan struct{}),
+	}
+	go client.writePump()
+	return client
+}
+
+// Send queues the message without blocking. A client whose queue is full is disconnected,
+// dropping messages would leave its view of the subscribed data silently out of date.
+func (c *Client) Send(message interface{}) error {
+	select {
+	case <-c.done:
+		return ErrClientClosed
+	default:
+	}
+	select {
+	case c.send <- message:
+		return nil
+	case <-c.done:
+		return ErrClientClosed
+	default:
+		c.disconnect()
+		return ErrSlowConsumer
+	}
+}
+
+// Close stops accepting messages, the ones already queued are written before the connection is closed
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// CloseWithReason closes the client like Close, then ends the connection with a close frame
+// holding the code (one of the websocket.Close* codes) and the reason
+func (c *Client) CloseWithReason(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode, c.closeReason = code, reason
+		close(c.done)
+	})
+}
+
+// disconnect closes the connection right away, dropping the queued messages
+func (c *Client) disconnect() {
+	c.Close()
+	c.Conn.Close()
+}
+
+// writePump writes the queued messages and the pings until the client is closed or a write fails.
+// Closing the connection ends the read loop of the client as well.
+func (c *Client) writePump() {
+	defer c.Conn.Close()
+	var ping <-chan time.Time
+	if c.heartbeat.PingInterval > 0 {
+		ticker := time.NewTicker(c.heartbeat.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	for {
+		select {
+		case message := <-c.send:
+			if !c.write(message) {
+				return
+			}
+		case <-ping:
+			c.Conn.SetWriteDeadline(c.heartbeat.deadline())
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Println("ping:", err)
+				c.Close()
+				return
+			}
+		case <-c.done:
+			// flush what was queued before the client was closed
+			for {
+				select {
+				case message := <-c.send:
+					if !c.write(message) {
+						return
+					}
+				default:
+					if c.closeCode != 0 {
+						c.Conn.SetWriteDeadline(c.heartbeat.deadline())
+						c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason))
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *Client) write(message interface{}) bool {
+	c.Conn.SetWriteDeadline(c.heartbeat.deadline())
+	if err := c.Conn.WriteJSON(message); err != nil {
+		log.Println("write:", err)
+		c.Close()
+		return false
+	}
+	return true
+}
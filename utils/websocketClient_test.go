@@ -0,0 +1,234 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var errFakeConnClosed = errors.New("fake connection closed")
+
+// fakeConn records what a Client writes. When block is set, writes wait until it is closed.
+type fakeConn struct {
+	written chan interface{}
+	started chan struct{}
+	block   chan struct{}
+	closed  chan struct{}
+
+	mu         sync.Mutex
+	closeFrame []byte
+	closeOnce  sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		written: make(chan interface{}, 2*clientQueueSize),
+		started: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (f *fakeConn) WriteJSON(v interface{}) error {
+	select {
+	case f.started <- struct{}{}:
+	default:
+	}
+	if f.block != nil {
+		select {
+		case <-f.block:
+		case <-f.closed:
+			return errFakeConnClosed
+		}
+	}
+	select {
+	case <-f.closed:
+		return errFakeConnClosed
+	default:
+	}
+	f.written <- v
+	return nil
+}
+
+func (f *fakeConn) WriteMessage(messageType int, data []byte) error {
+	if messageType == websocket.CloseMessage {
+		f.mu.Lock()
+		f.closeFrame = data
+		f.mu.Unlock()
+	}
+	return nil
+}
+
+func (f *fakeConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (f *fakeConn) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+	})
+	return nil
+}
+
+// next returns the next written message, failing the test when none comes
+func (f *fakeConn) next(t *testing.T) interface{} {
+	t.Helper()
+	select {
+	case message := <-f.written:
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message written")
+		return nil
+	}
+}
+
+// until returns the messages written before the sentinel
+func (f *fakeConn) until(t *testing.T, sentinel interface{}) []interface{} {
+	t.Helper()
+	messages := make([]interface{}, 0)
+	for {
+		message := f.next(t)
+		if message == sentinel {
+			return messages
+		}
+		messages = append(messages, message)
+	}
+}
+
+func waitClosed(t *testing.T, f *fakeConn) {
+	t.Helper()
+	select {
+	case <-f.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+func newTestManager() *WebsocketManager {
+	wm := NewWebsocketManager()
+	wm.Heartbeat = HeartbeatConfig{}
+	return wm
+}
+
+func TestConcurrentSendBroadcastRemove(t *testing.T) {
+	wm := newTestManager()
+	conns := make([]*fakeConn, 8)
+	for i := range conns {
+		conns[i] = newFakeConn()
+		go func(f *fakeConn) {
+			// drain like a reading peer
+			for {
+				select {
+				case <-f.written:
+				case <-f.closed:
+					return
+				}
+			}
+		}(conns[i])
+		wm.AddClient(fmt.Sprint(i), conns[i])
+		wm.Subscribe(fmt.Sprint(i), "rooms")
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			id := fmt.Sprint(worker)
+			for i := 0; i < 50; i++ {
+				wm.Broadcast(i, id)
+				wm.Publish("rooms.42", i)
+				wm.SendToUser(id, i)
+				wm.SetIdentity(id, &Identity{UserID: "user"})
+				wm.SendToIdentity("user", i)
+				wm.Join(id, "room")
+				wm.SendToGroup("room", i)
+				wm.Identity(id)
+			}
+			if worker%2 == 0 {
+				wm.RemoveClient(id)
+				wm.AddClient(id, newFakeConn())
+				wm.RemoveClient(id)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	for i := 0; i < 8; i += 2 {
+		waitClosed(t, conns[i])
+	}
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	if len(wm.clients) != 4 {
+		t.Fatalf("expected 4 clients left, got %d", len(wm.clients))
+	}
+}
+
+func TestSlowConsumerDisconnected(t *testing.T) {
+	conn := newFakeConn()
+	conn.block = make(chan struct{})
+	client := newClient(conn, HeartbeatConfig{})
+
+	// the writer takes the first message and blocks on it, the queue then fills up
+	if err := client.Send(0); err != nil {
+		t.Fatal(err)
+	}
+	<-conn.started
+	for i := 1; i <= clientQueueSize; i++ {
+		if err := client.Send(i); err != nil {
+			t.Fatalf("message %d: %s", i, err)
+		}
+	}
+	if err := client.Send("overflow"); !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("expected ErrSlowConsumer, got %v", err)
+	}
+	waitClosed(t, conn)
+	if err := client.Send("after"); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("expected ErrClientClosed, got %v", err)
+	}
+}
+
+func TestWritePumpFlushesThenCloses(t *testing.T) {
+	conn := newFakeConn()
+	conn.block = make(chan struct{})
+	client := newClient(conn, HeartbeatConfig{})
+
+	for _, message := range []string{"a", "b", "c"} {
+		if err := client.Send(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.CloseWithReason(websocket.ClosePolicyViolation, "Unauthorized")
+	if err := client.Send("d"); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("expected ErrClientClosed, got %v", err)
+	}
+	close(conn.block)
+
+	for _, expected := range []string{"a", "b", "c"} {
+		if message := conn.next(t); message != expected {
+			t.Fatalf("expected %q, got %v", expected, message)
+		}
+	}
+	waitClosed(t, conn)
+	select {
+	case message := <-conn.written:
+		t.Fatalf("unexpected message %v", message)
+	default:
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if len(conn.closeFrame) < 2 {
+		t.Fatal("no close frame written")
+	}
+	if code := binary.BigEndian.Uint16(conn.closeFrame); code != websocket.ClosePolicyViolation {
+		t.Fatalf("expected close code %d, got %d", websocket.ClosePolicyViolation, code)
+	}
+	if reason := string(conn.closeFrame[2:]); reason != "Unauthorized" {
+		t.Fatalf("expected reason Unauthorized, got %q", reason)
+	}
+}
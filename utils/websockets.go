@@ -3,12 +3,38 @@ package utils
 import (
 	"errors"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"safestore/database"
 
 	"github.com/gorilla/websocket"
 )
 
+// WebsocketManager is the registry of the connected clients and of their subscriptions,
+// it is safe for concurrent use by the connection handlers and the change feed
 type WebsocketManager struct {
-	clients map[string]*websocket.Conn
+	// Heartbeat applies to the clients added after it is set
+	Heartbeat HeartbeatConfig
+
+	mu      sync.RWMutex
+	clients map[string]*Client
+	// subscriptions maps a client ID to the set of ltree path prefixes it listens to
+	subscriptions map[string]map[string]struct{}
+	// documentSubscriptions maps a client ID to the set of watched collections and documents
+	documentSubscriptions map[string]map[documentTopic]struct{}
+	// users maps the id of an authenticated user to the IDs of its clients, a user may have several connections
+	users map[string]map[string]struct{}
+	// groups maps a group (or room) to the IDs of the clients which joined it
+	groups map[string]map[string]struct{}
+}
+
+// documentTopic is a watched collection, or a single document of it when ID is set
+type documentTopic struct {
+	Collection string
+	ID         string
 }
 
 type OpEnum int // OpEnum is an enum for the websocket operations
@@ -18,11 +44,36 @@ const (
 	DeleteOp
 	UpdateOp
 	GetOp
+	SubscribeOp
+	UnsubscribeOp
+	DocumentSubscribeOp
+	DocumentUnsubscribeOp
+	DocumentChangeOp
+	LiveQueryOp
+	LiveQueryStopOp
+	LiveQueryResultOp
+	LiveQueryChangeOp
+	MultiUpdateOp
+	TransactionReadOp
+	TransactionCommitOp
+	TreeQueryOp
+	// ErrorOp reports a message which could not be read as an Envelope
+	ErrorOp
 )
 
+// WebSocketQuery is a message sent to the websocket clients, requests are read as an Envelope.
+// The reply to a request is sent to the requesting connection only, with the ID of the request and either Data or Error.
 type WebSocketQuery struct {
-	Op   OpEnum      `json:"op"`
-	Data interface{} `json:"data"`
+	Op    OpEnum      `json:"op"`
+	ID    string      `json:"id,omitempty"`
+	Data  interface{} `json:"data"`
+	Error *ReplyError `json:"error,omitempty"`
+}
+
+// ReplyError is the failure of a request, Code follows the HTTP status codes (400, 401, 403, 404, 409, 500)
+type ReplyError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
 }
 
 type AuthPayload struct {
@@ -33,55 +84,355 @@ type AuthPayload struct {
 type CrudPayload struct {
 	Path string                 `json:"path"`
 	Data map[string]interface{} `json:"data"`
+	// Shallow and Depth limit the subtree returned by GetOp, see database.TreeReadOptions
+	Shallow bool `json:"shallow,omitempty"`
+	Depth   int  `json:"depth,omitempty"`
+}
+
+// MultiUpdatePayload maps paths to their new values, null deleting the path
+type MultiUpdatePayload struct {
+	Updates map[string]interface{} `json:"updates"`
+}
+
+type SubscriptionPayload struct {
+	Path string `json:"path"`
+}
+
+// TreeQueryPayload queries the children of the node at Path, the reply holds them in order
+type TreeQueryPayload struct {
+	Path string `json:"path"`
+	database.TreeQuery
+}
+
+// DocumentSubscriptionPayload watches a whole collection, or a single document when ID is set
+type DocumentSubscriptionPayload struct {
+	Collection string `json:"collection"`
+	ID         string `json:"id"`
+}
+
+const (
+	DocumentAdded    = "added"
+	DocumentModified = "modified"
+	DocumentRemoved  = "removed"
+)
+
+// DocumentChange is the data of a DocumentChangeOp message, ID is empty when a whole collection is removed
+type DocumentChange struct {
+	Type       string      `json:"type"`
+	Collection string      `json:"collection"`
+	ID         string      `json:"id"`
+	Data       interface{} `json:"data,omitempty"`
 }
 
 func NewWebsocketManager() *WebsocketManager {
 	return &WebsocketManager{
-		clients: make(map[string]*websocket.Conn),
+		Heartbeat:     DefaultHeartbeat,
+		clients:       make(map[string]*Client),
+		subscriptions: make(map[string]map[string]struct{}),
+
+		documentSubscriptions: make(map[string]map[documentTopic]struct{}),
+		users:                 make(map[string]map[string]struct{}),
+		groups:                make(map[string]map[string]struct{}),
+	}
+}
+
+// AddClient registers the connection and starts writing its queued messages
+func (wm *WebsocketManager) AddClient(userID string, conn Conn) *Client {
+	client := newClient(conn, wm.Heartbeat)
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	wm.clients[userID] = client
+	return client
+}
+
+// RequireAuth closes the client with ClosePolicyViolation unless it is authenticated within
+// the AuthTimeout of the heartbeat. The returned function cancels the deadline.
+func (wm *WebsocketManager) RequireAuth(userID string, client *Client) func() bool {
+	if wm.Heartbeat.AuthTimeout == 0 {
+		return func() bool { return false }
+	}
+	timer := time.AfterFunc(wm.Heartbeat.AuthTimeout, func() {
+		if wm.Identity(userID) == nil {
+			client.CloseWithReason(websocket.ClosePolicyViolation, "Authentication timeout")
+		}
+	})
+	return timer.Stop
+}
+
+// SetIdentity attaches the authenticated identity to a connected client
+func (wm *WebsocketManager) SetIdentity(userID string, identity *Identity) error {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	client, ok := wm.clients[userID]
+	if !ok {
+		return errors.New("user not found")
+	}
+	if client.Identity != nil {
+		removeMember(wm.users, client.Identity.UserID, userID)
 	}
+	client.Identity = identity
+	if identity != nil {
+		addMember(wm.users, identity.UserID, userID)
+	}
+	return nil
 }
 
-func (wm *WebsocketManager) AddClient(userID string, conn *websocket.Conn) {
-	wm.clients[userID] = conn
+// Identity returns the identity of the client, nil when it is not authenticated
+func (wm *WebsocketManager) Identity(userID string) *Identity {
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	client, ok := wm.clients[userID]
+	if !ok {
+		return nil
+	}
+	return client.Identity
 }
 
+// RemoveClient unregisters the client and its subscriptions, the messages already queued are still written
 func (wm *WebsocketManager) RemoveClient(userID string) {
+	wm.mu.Lock()
+	client, ok := wm.clients[userID]
 	delete(wm.clients, userID)
+	delete(wm.subscriptions, userID)
+	delete(wm.documentSubscriptions, userID)
+	if ok && client.Identity != nil {
+		removeMember(wm.users, client.Identity.UserID, userID)
+	}
+	for group := range wm.groups {
+		removeMember(wm.groups, group, userID)
+	}
+	wm.mu.Unlock()
+	if ok {
+		client.Close()
+	}
 }
 
-func (wm *WebsocketManager) Broadcast(message interface{}, exclude ...string) {
-	for userID, conn := range wm.clients {
-		for _, ex := range exclude {
-			if userID == ex {
+// Subscribe registers the interest of a client in every change under the given ltree path prefix
+func (wm *WebsocketManager) Subscribe(userID string, path string) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	addMember(wm.subscriptions, userID, path)
+}
+
+func (wm *WebsocketManager) Unsubscribe(userID string, path string) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	removeMember(wm.subscriptions, userID, path)
+}
+
+// Publish sends the message to every client subscribed to a prefix related to the changed path.
+// A subscription is related when the change happens under it, or when the change replaces
+// a whole subtree containing it (e.g. deleting `rooms` affects a subscriber of `rooms.42`).
+func (wm *WebsocketManager) Publish(path string, message interface{}) {
+	wm.PublishPaths([]string{path}, message)
+}
+
+// PublishPaths sends the message once to every client subscribed to a prefix related to any of the changed paths
+func (wm *WebsocketManager) PublishPaths(paths []string, message interface{}) {
+	wm.PublishPathsFunc(paths, func(*Identity, []string) []interface{} {
+		return []interface{}{message}
+	})
+}
+
+// PublishPathsFunc sends to every client subscribed to a prefix related to any of the changed paths
+// the messages built for it from its identity and its related prefixes, sorted
+func (wm *WebsocketManager) PublishPathsFunc(paths []string, messages func(identity *Identity, prefixes []string) []interface{}) {
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	for userID, prefixes := range wm.subscriptions {
+		client, ok := wm.clients[userID]
+		if !ok {
+			continue
+		}
+		related := relatedPrefixes(paths, prefixes)
+		if len(related) == 0 {
+			continue
+		}
+		for _, message := range messages(client.Identity, related) {
+			sendTo(userID, client, message)
+		}
+	}
+}
+
+// relatedPrefixes returns the prefixes a change on any of the paths happens under, or replaces
+func relatedPrefixes(paths []string, prefixes map[string]struct{}) []string {
+	related := make([]string, 0)
+	for prefix := range prefixes {
+		for _, path := range paths {
+			if isUnderPath(path, prefix) || isUnderPath(prefix, path) {
+				related = append(related, prefix)
+				break
+			}
+		}
+	}
+	sort.Strings(related)
+	return related
+}
+
+// SubscribeDocuments registers the interest of a client in the changes of a collection or of one of its documents
+func (wm *WebsocketManager) SubscribeDocuments(userID string, collection string, id string) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if _, ok := wm.documentSubscriptions[userID]; !ok {
+		wm.documentSubscriptions[userID] = make(map[documentTopic]struct{})
+	}
+	wm.documentSubscriptions[userID][documentTopic{Collection: collection, ID: id}] = struct{}{}
+}
+
+func (wm *WebsocketManager) UnsubscribeDocuments(userID string, collection string, id string) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	topics, ok := wm.documentSubscriptions[userID]
+	if !ok {
+		return
+	}
+	delete(topics, documentTopic{Collection: collection, ID: id})
+	if len(topics) == 0 {
+		delete(wm.documentSubscriptions, userID)
+	}
+}
+
+// PublishDocument sends the message to every client watching the collection or the document.
+// An empty id stands for the whole collection and reaches the watchers of each of its documents.
+func (wm *WebsocketManager) PublishDocument(collection string, id string, message interface{}) {
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	for userID, topics := range wm.documentSubscriptions {
+		client, ok := wm.clients[userID]
+		if !ok {
+			continue
+		}
+		for topic := range topics {
+			if topic.Collection != collection || (topic.ID != "" && id != "" && topic.ID != id) {
 				continue
-			} else {
-				err := conn.WriteJSON(message)
-				if err != nil {
-					log.Printf("error writing message to %s: %s", userID, err)
-				}
 			}
+			sendTo(userID, client, message)
+			// deliver each change only once per client
+			break
+		}
+	}
+}
+
+// isUnderPath reports whether the ltree path is equal to or a descendant of the prefix
+func isUnderPath(path, prefix string) bool {
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+".")
+}
+
+// Broadcast sends the message to every connected client but the excluded client IDs
+func (wm *WebsocketManager) Broadcast(message interface{}, exclude ...string) {
+	excluded := newSet(exclude)
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	for userID, client := range wm.clients {
+		if _, ok := excluded[userID]; ok {
+			continue
 		}
+		sendTo(userID, client, message)
 	}
 }
 
+// SendToUser sends the message to the client with the given ID
 func (wm *WebsocketManager) SendToUser(userID string, message interface{}) error {
-	conn, ok := wm.clients[userID]
+	wm.mu.RLock()
+	client, ok := wm.clients[userID]
+	wm.mu.RUnlock()
 	if !ok {
 		return errors.New("user not found")
 	}
-	return conn.WriteJSON(message)
+	return client.Send(message)
 }
 
 func (wm *WebsocketManager) SendToMultipleUsers(userIDs []string, message interface{}) {
-	// send to existing clients only
-	for _, userID := range userIDs {
-		conn, ok := wm.clients[userID]
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	// send to existing clients only, once each
+	for userID := range newSet(userIDs) {
+		client, ok := wm.clients[userID]
 		if !ok {
 			continue
 		}
-		err := conn.WriteJSON(message)
-		if err != nil {
-			log.Printf("error writing message to %s: %s", userID, err)
+		sendTo(userID, client, message)
+	}
+}
+
+// SendToIdentity sends the message to every client authenticated as the user with the given uid,
+// it returns the number of clients reached
+func (wm *WebsocketManager) SendToIdentity(uid string, message interface{}, exclude ...string) int {
+	return wm.sendToMembers(wm.users, uid, message, exclude)
+}
+
+// Join adds the client to a group, a client can be in several groups
+func (wm *WebsocketManager) Join(userID string, group string) error {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if _, ok := wm.clients[userID]; !ok {
+		return errors.New("user not found")
+	}
+	addMember(wm.groups, group, userID)
+	return nil
+}
+
+// Leave removes the client from a group, the group is dropped once empty
+func (wm *WebsocketManager) Leave(userID string, group string) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	removeMember(wm.groups, group, userID)
+}
+
+// SendToGroup sends the message to every client of the group but the excluded client IDs,
+// it returns the number of clients reached
+func (wm *WebsocketManager) SendToGroup(group string, message interface{}, exclude ...string) int {
+	return wm.sendToMembers(wm.groups, group, message, exclude)
+}
+
+func (wm *WebsocketManager) sendToMembers(index map[string]map[string]struct{}, key string, message interface{}, exclude []string) int {
+	excluded := newSet(exclude)
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	sent := 0
+	for userID := range index[key] {
+		if _, ok := excluded[userID]; ok {
+			continue
 		}
+		client, ok := wm.clients[userID]
+		if !ok {
+			continue
+		}
+		sendTo(userID, client, message)
+		sent++
+	}
+	return sent
+}
+
+func addMember(index map[string]map[string]struct{}, key string, userID string) {
+	if _, ok := index[key]; !ok {
+		index[key] = make(map[string]struct{})
+	}
+	index[key][userID] = struct{}{}
+}
+
+func removeMember(index map[string]map[string]struct{}, key string, userID string) {
+	members, ok := index[key]
+	if !ok {
+		return
+	}
+	delete(members, userID)
+	if len(members) == 0 {
+		delete(index, key)
+	}
+}
+
+func newSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		set[value] = struct{}{}
+	}
+	return set
+}
+
+// sendTo queues the message for the client, a slow client is disconnected and its read loop removes it
+func sendTo(userID string, client *Client, message interface{}) {
+	if err := client.Send(message); err != nil {
+		log.Printf("error writing message to %s: %s", userID, err)
 	}
 }
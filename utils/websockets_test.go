@@ -0,0 +1,272 @@
+package utils
+
+import (
+	"encoding/binary"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const flush = "flush"
+
+// connect adds a client with a fake connection for each ID
+func connect(wm *WebsocketManager, ids ...string) map[string]*fakeConn {
+	conns := make(map[string]*fakeConn, len(ids))
+	for _, id := range ids {
+		conns[id] = newFakeConn()
+		wm.AddClient(id, conns[id])
+	}
+	return conns
+}
+
+// receivers returns the IDs of the clients which got the message before the flush sentinel
+func receivers(t *testing.T, wm *WebsocketManager, conns map[string]*fakeConn, message interface{}) []string {
+	t.Helper()
+	got := make([]string, 0)
+	for id, conn := range conns {
+		if err := wm.SendToUser(id, flush); err != nil {
+			continue
+		}
+		for _, m := range conn.until(t, flush) {
+			if m == message {
+				got = append(got, id)
+			}
+		}
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestBroadcastExclude(t *testing.T) {
+	tests := []struct {
+		name     string
+		exclude  []string
+		expected []string
+	}{
+		{"no exclusion", nil, []string{"a", "b", "c"}},
+		{"one excluded", []string{"b"}, []string{"a", "c"}},
+		{"several excluded", []string{"a", "c"}, []string{"b"}},
+		{"unknown excluded", []string{"z"}, []string{"a", "b", "c"}},
+		{"all excluded", []string{"a", "b", "c"}, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wm := newTestManager()
+			conns := connect(wm, "a", "b", "c")
+			wm.Broadcast("hello", test.exclude...)
+			if got := receivers(t, wm, conns, "hello"); !reflect.DeepEqual(got, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestSendToIdentity(t *testing.T) {
+	tests := []struct {
+		name       string
+		identities map[string]string
+		uid        string
+		exclude    []string
+		expected   []string
+	}{
+		{"one connection", map[string]string{"a": "alice", "b": "bob"}, "alice", nil, []string{"a"}},
+		{"several connections", map[string]string{"a": "alice", "b": "alice", "c": "bob"}, "alice", nil, []string{"a", "b"}},
+		{"excluded connection", map[string]string{"a": "alice", "b": "alice"}, "alice", []string{"a"}, []string{"b"}},
+		{"unauthenticated", map[string]string{"a": "alice"}, "bob", nil, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wm := newTestManager()
+			conns := connect(wm, "a", "b", "c")
+			for id, uid := range test.identities {
+				if err := wm.SetIdentity(id, &Identity{UserID: uid}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if sent := wm.SendToIdentity(test.uid, "hello", test.exclude...); sent != len(test.expected) {
+				t.Fatalf("expected %d clients reached, got %d", len(test.expected), sent)
+			}
+			if got := receivers(t, wm, conns, "hello"); !reflect.DeepEqual(got, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestIdentityIndexFollowsReauthentication(t *testing.T) {
+	wm := newTestManager()
+	conns := connect(wm, "a", "b")
+	wm.SetIdentity("a", &Identity{UserID: "alice"})
+	wm.SetIdentity("b", &Identity{UserID: "alice"})
+	wm.SetIdentity("b", &Identity{UserID: "bob"})
+	wm.RemoveClient("a")
+	delete(conns, "a")
+
+	if sent := wm.SendToIdentity("alice", "hello"); sent != 0 {
+		t.Fatalf("expected no client for alice, got %d", sent)
+	}
+	if got := receivers(t, wm, conns, "hello"); len(got) != 0 {
+		t.Fatalf("expected no receiver, got %v", got)
+	}
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	if _, ok := wm.users["alice"]; ok {
+		t.Fatal("alice is still indexed")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	tests := []struct {
+		name     string
+		members  []string
+		leave    []string
+		remove   []string
+		exclude  []string
+		expected []string
+	}{
+		{"members", []string{"a", "b"}, nil, nil, nil, []string{"a", "b"}},
+		{"excluded member", []string{"a", "b"}, nil, nil, []string{"a"}, []string{"b"}},
+		{"left member", []string{"a", "b"}, []string{"a"}, nil, nil, []string{"b"}},
+		{"removed client", []string{"a", "b", "c"}, nil, []string{"b"}, nil, []string{"a", "c"}},
+		{"every member removed", []string{"a", "b"}, []string{"a"}, []string{"b"}, nil, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wm := newTestManager()
+			conns := connect(wm, "a", "b", "c")
+			for _, id := range test.members {
+				if err := wm.Join(id, "room"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, id := range test.leave {
+				wm.Leave(id, "room")
+			}
+			for _, id := range test.remove {
+				wm.RemoveClient(id)
+				delete(conns, id)
+			}
+			if sent := wm.SendToGroup("room", "hello", test.exclude...); sent != len(test.expected) {
+				t.Fatalf("expected %d clients reached, got %d", len(test.expected), sent)
+			}
+			if got := receivers(t, wm, conns, "hello"); !reflect.DeepEqual(got, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, got)
+			}
+			wm.mu.RLock()
+			defer wm.mu.RUnlock()
+			if _, ok := wm.groups["room"]; ok != (len(test.members) > len(test.leave)+len(test.remove)) {
+				t.Fatalf("unexpected group registry %v", wm.groups)
+			}
+		})
+	}
+}
+
+func TestJoinUnknownClient(t *testing.T) {
+	wm := newTestManager()
+	if err := wm.Join("ghost", "room"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestPublishPathsMatchesSubscriptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		paths    []string
+		received bool
+	}{
+		{"same path", []string{"rooms.42"}, []string{"rooms.42"}, true},
+		{"change under the subscription", []string{"rooms"}, []string{"rooms.42.name"}, true},
+		{"change replacing the subscription", []string{"rooms.42"}, []string{"rooms"}, true},
+		{"root subscription", []string{""}, []string{"users.1"}, true},
+		{"root change", []string{"rooms.42"}, []string{""}, true},
+		{"sibling", []string{"rooms.42"}, []string{"rooms.43"}, false},
+		{"label prefix is not a path prefix", []string{"rooms.4"}, []string{"rooms.42"}, false},
+		{"one of several paths", []string{"users"}, []string{"rooms.1", "users.1"}, true},
+		{"one of several prefixes", []string{"rooms.1", "users"}, []string{"users.2"}, true},
+		{"unsubscribed", nil, []string{"rooms"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wm := newTestManager()
+			conns := connect(wm, "a")
+			for _, prefix := range test.prefixes {
+				wm.Subscribe("a", prefix)
+			}
+			wm.PublishPaths(test.paths, "change")
+			got := receivers(t, wm, conns, "change")
+			if received := len(got) == 1; received != test.received {
+				t.Fatalf("expected received=%v, got %v", test.received, got)
+			}
+		})
+	}
+}
+
+func TestPublishPathsDeliversOncePerClient(t *testing.T) {
+	wm := newTestManager()
+	conns := connect(wm, "a")
+	wm.Subscribe("a", "rooms")
+	wm.Subscribe("a", "rooms.42")
+	wm.PublishPaths([]string{"rooms.42", "rooms.43"}, "change")
+	wm.SendToUser("a", flush)
+	if messages := conns["a"].until(t, flush); len(messages) != 1 {
+		t.Fatalf("expected one message, got %v", messages)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	wm := newTestManager()
+	conns := connect(wm, "a")
+	wm.Subscribe("a", "rooms")
+	wm.Unsubscribe("a", "rooms")
+	wm.Publish("rooms.42", "change")
+	if got := receivers(t, wm, conns, "change"); len(got) != 0 {
+		t.Fatalf("expected no receiver, got %v", got)
+	}
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	if len(wm.subscriptions) != 0 {
+		t.Fatalf("expected no subscription left, got %v", wm.subscriptions)
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	tests := []struct {
+		name         string
+		authenticate bool
+		closed       bool
+	}{
+		{"unauthenticated", false, true},
+		{"authenticated", true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wm := newTestManager()
+			wm.Heartbeat.AuthTimeout = 20 * time.Millisecond
+			conn := newFakeConn()
+			client := wm.AddClient("a", conn)
+			defer wm.RequireAuth("a", client)()
+			if test.authenticate {
+				wm.SetIdentity("a", &Identity{UserID: "alice"})
+			}
+			select {
+			case <-conn.closed:
+				if !test.closed {
+					t.Fatal("authenticated client closed")
+				}
+				conn.mu.Lock()
+				defer conn.mu.Unlock()
+				if code := binary.BigEndian.Uint16(conn.closeFrame); code != websocket.ClosePolicyViolation {
+					t.Fatalf("expected close code %d, got %d", websocket.ClosePolicyViolation, code)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if test.closed {
+					t.Fatal("unauthenticated client not closed")
+				}
+			}
+		})
+	}
+}